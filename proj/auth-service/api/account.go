@@ -0,0 +1,264 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+//userTables are the auth tables with rows keyed by userId. All of them are emptied when
+//an account is deleted, so every new per-user table has to be added here. auth_events is
+//left out on purpose, the audit log is append-only.
+var userTables = []string{
+	"refresh_tokens",
+	"sessions",
+	"auth_tokens",
+	"mfa_totp",
+	"mfa_recovery_codes",
+	"user_roles",
+	"api_keys",
+	"oauth_clients",
+	"oauth_grants",
+	"external_identities",
+	"webauthn_credentials",
+}
+
+//Outbox events. eventPurgeUser asks a service to delete everything of a user and
+//eventEmailChanged pushes a confirmed email address to profiles.
+const (
+	eventPurgeUser    = "purge_user"
+	eventEmailChanged = "email_changed"
+)
+
+//reauthWindow is how recently a user without a password must have signed in for
+//reauthenticate to let them through
+var reauthWindow = 5 * time.Minute
+
+var errReauthRequired = errors.New("sign in again to do this")
+
+//deletionStatus is the progress of an account deletion across the services
+type deletionStatus struct {
+	JobID       string            `json:"jobId"`
+	Status      string            `json:"status"`
+	Services    []deletionService `json:"services"`
+	CompletedAt *time.Time        `json:"completedAt,omitempty"`
+}
+
+type deletionService struct {
+	Service   string `json:"service"`
+	Completed bool   `json:"completed"`
+	Attempts  int    `json:"attempts"`
+}
+
+//deleteAccount deletes the logged in user. The auth rows go right away, posts and
+//profiles are purged by the outbox worker and the returned job reports their progress.
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	credentials := Credentials{}
+	err := json.NewDecoder(r.Body).Decode(&credentials)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding credentials from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	//Deleting can't be undone, make sure it is the user asking
+	limits := []limitKey{{accountLimiter, "delete:user:" + claims.UserID}}
+	if !checkLimits(w, limits...) {
+		return
+	}
+	if !reauthenticate(w, claims, credentials.Password, limits...) {
+		return
+	}
+
+	jobID := uuid.New().String()
+	err = purgeUser(claims.UserID, jobID)
+	if err != nil {
+		http.Error(w, errors.New("error deleting account").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	//Without a session row every token of the user is already dead, drop the cookies too
+	expireCookies(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/auth/account/deletions/"+jobID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(deletionStatus{JobID: jobID, Status: "pending", Services: []deletionService{}})
+}
+
+//reauthenticate checks that a request that can't be undone comes from the user and not
+//just from their access token. Users with a password have to type it again. Users
+//without one, who sign in with a passkey, single sign-on or a magic link, have to have
+//signed in within reauthWindow instead. A failed password counts against limits. It
+//writes the error and returns false if the check fails.
+func reauthenticate(w http.ResponseWriter, claims *authn.AuthClaims, password string, limits ...limitKey) bool {
+	var hashedPassword string
+	err := DB.QueryRow("SELECT hashedPassword FROM users WHERE userId = ?", claims.UserID).Scan(&hashedPassword)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return false
+	}
+
+	if hashedPassword == "" {
+		sessions, err := sessionStore.ListSessions(claims.UserID)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving session").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return false
+		}
+		for _, session := range sessions {
+			if session.ID == claims.SessionID && time.Since(session.CreatedAt) < reauthWindow {
+				return true
+			}
+		}
+		http.Error(w, errReauthRequired.Error(), http.StatusUnauthorized)
+		return false
+	}
+
+	if len(password) < 1 {
+		http.Error(w, "400", http.StatusBadRequest)
+		return false
+	}
+	match, _, err := verifyPassword(hashedPassword, password)
+	if err != nil {
+		http.Error(w, errors.New("error checking password").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return false
+	}
+	if !match {
+		recordAttempts(limits...)
+		http.Error(w, errors.New("password entered does not match records").Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+//purgeUser deletes the user's auth rows and queues the purge of the other services in
+//one transaction, so the cascade can't be lost halfway
+func purgeUser(userID string, jobID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//The user's OAuth clients go with them, so like deleteOAuthClient the grants and
+	//sessions other users gave those clients have to go too
+	rows, err := tx.Query("SELECT clientId FROM oauth_clients WHERE userId = ?", userID)
+	if err != nil {
+		return err
+	}
+	clientIDs := []string{}
+	for rows.Next() {
+		var clientID string
+		if err = rows.Scan(&clientID); err != nil {
+			rows.Close()
+			return err
+		}
+		clientIDs = append(clientIDs, clientID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, clientID := range clientIDs {
+		_, err = tx.Exec("DELETE FROM oauth_grants WHERE clientId = ?", clientID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE sessions SET revokedAt = ? WHERE clientId = ? AND revokedAt IS NULL", time.Now(), clientID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, table := range userTables {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE userId = ?", userID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE userId = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range []string{targetPosts, targetProfiles} {
+		err = enqueueEvent(tx, jobID, eventPurgeUser, target, http.MethodDelete, "/internal/users/"+userID, "")
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//getDeletionStatus reports how far the purge of a deleted account has got. The user
+//can't log in anymore, so the unguessable job id is all that's asked for.
+func getDeletionStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	jobID := mux.Vars(r)["jobId"]
+	rows, err := DB.Query("SELECT target, attempts, completedAt FROM outbox_events WHERE jobId = ? AND eventType = ? ORDER BY target", jobID, eventPurgeUser)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving deletion status").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	status := deletionStatus{JobID: jobID, Status: "completed", Services: []deletionService{}}
+	for rows.Next() {
+		var service deletionService
+		var completedAt sql.NullTime
+		err = rows.Scan(&service.Service, &service.Attempts, &completedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving deletion status").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		service.Completed = completedAt.Valid
+		if !completedAt.Valid {
+			status.Status = "pending"
+		} else if status.CompletedAt == nil || completedAt.Time.After(*status.CompletedAt) {
+			t := completedAt.Time
+			status.CompletedAt = &t
+		}
+		status.Services = append(status.Services, service)
+	}
+	if len(status.Services) == 0 {
+		http.Error(w, errors.New("no such deletion").Error(), http.StatusNotFound)
+		return
+	}
+	if status.Status != "completed" {
+		status.CompletedAt = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
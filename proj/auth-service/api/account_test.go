@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccountNeedsPassword(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "delpw")
+
+	w := request(t, http.MethodDelete, "/api/auth/account", map[string]string{"password": "not my password"}, user.Cookies...)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d %s, want 401", w.Code, w.Body.String())
+	}
+	w = request(t, http.MethodDelete, "/api/auth/account", map[string]string{}, user.Cookies...)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("no password: got %d %s, want 400", w.Code, w.Body.String())
+	}
+	w = request(t, http.MethodDelete, "/api/auth/account", map[string]string{"password": user.Password}, user.Cookies...)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("delete account: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteAccountWithoutPassword(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+	w := p.login(t, "/api/auth/oidc/mock/callback")
+	userID := loggedInAs(t, w)
+
+	//An SSO user has no password to type, a login that isn't recent doesn't do instead
+	_, err := DB.Exec("UPDATE sessions SET createdAt = ? WHERE userId = ?", time.Now().Add(-time.Hour), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := request(t, http.MethodDelete, "/api/auth/account", map[string]string{}, w.Result().Cookies()...)
+	if stale.Code != http.StatusUnauthorized {
+		t.Fatalf("stale login: got %d %s, want 401", stale.Code, stale.Body.String())
+	}
+
+	//Signing in again right before is enough
+	w = p.login(t, "/api/auth/oidc/mock/callback")
+	fresh := request(t, http.MethodDelete, "/api/auth/account", map[string]string{}, w.Result().Cookies()...)
+	if fresh.Code != http.StatusAccepted {
+		t.Fatalf("fresh login: got %d %s, want 202", fresh.Code, fresh.Body.String())
+	}
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT * FROM users WHERE userId = ?)", userID).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("the user is still there")
+	}
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/gorilla/mux"
+)
+
+//rolesRequest is the body of PUT /api/auth/admin/users/{userId}/roles
+type rolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+//loadRoles returns the roles of the user, sorted by name
+func loadRoles(userID string) ([]string, error) {
+	rows, err := DB.Query("SELECT role FROM user_roles WHERE userId = ? ORDER BY role", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err = rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+//userExists writes a 404 and returns false if there is no user with the id
+func userExists(w http.ResponseWriter, userID string) bool {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS (SELECT * FROM users WHERE userId = ?)", userID).Scan(&exists)
+	if err != nil {
+		http.Error(w, errors.New("error checking if user exists").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return false
+	}
+	if !exists {
+		http.Error(w, errors.New("this user does not exist").Error(), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+//lockAccount stops the user from logging in and ends every session they have
+func lockAccount(w http.ResponseWriter, r *http.Request) {
+	setLocked(w, r, true)
+}
+
+//unlockAccount lets a locked user log in again
+func unlockAccount(w http.ResponseWriter, r *http.Request) {
+	setLocked(w, r, false)
+}
+
+func setLocked(w http.ResponseWriter, r *http.Request, locked bool) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	userID := mux.Vars(r)["userId"]
+	if locked && userID == claims.UserID {
+		http.Error(w, errors.New("you can't lock your own account").Error(), http.StatusBadRequest)
+		return
+	}
+	if !userExists(w, userID) {
+		return
+	}
+
+	_, err := DB.Exec("UPDATE users SET locked = ? WHERE userId = ?", locked, userID)
+	if err != nil {
+		http.Error(w, errors.New("error updating account").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if locked {
+		err = sessionStore.RevokeAllSessions(userID)
+		if err != nil {
+			http.Error(w, errors.New("error revoking sessions").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+	log.Printf("%s set locked=%t on %s", claims.UserID, locked, userID)
+}
+
+//getRoles returns the roles of a user
+func getRoles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	userID := mux.Vars(r)["userId"]
+	if !userExists(w, userID) {
+		return
+	}
+	roles, err := loadRoles(userID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving roles").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rolesRequest{Roles: roles})
+}
+
+//setRoles replaces the roles of a user. Tokens carry the roles they were minted with,
+//so the user's sessions are ended and the new roles apply from their next login.
+func setRoles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	userID := mux.Vars(r)["userId"]
+
+	request := rolesRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding roles from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	keepsAdmin := false
+	for _, role := range request.Roles {
+		if !authn.ValidRole(role) {
+			http.Error(w, errors.New("unknown role "+role).Error(), http.StatusBadRequest)
+			return
+		}
+		if role == authn.RoleAdmin {
+			keepsAdmin = true
+		}
+	}
+	//Otherwise the last admin could leave nobody able to manage roles
+	if userID == claims.UserID && !keepsAdmin {
+		http.Error(w, errors.New("you can't take away your own admin role").Error(), http.StatusBadRequest)
+		return
+	}
+	if !userExists(w, userID) {
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, errors.New("error updating roles").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM user_roles WHERE userId = ?", userID)
+	for _, role := range request.Roles {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT IGNORE INTO user_roles (userId, role) VALUES (?, ?)", userID, role)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, errors.New("error updating roles").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	err = sessionStore.RevokeAllSessions(userID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	log.Printf("%s set the roles of %s to %v", claims.UserID, userID, request.Roles)
+}
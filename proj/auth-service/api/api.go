@@ -10,17 +10,14 @@ import (
 	"time"
 	"strings"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"github.com/sendgrid/sendgrid-go"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	verifyTokenSize = 6
-	resetTokenSize  = 6
+	//tokenSize is the length of the tokens we email out, 32 base62 characters is about 190 bits
+	tokenSize = 32
 )
 
 // RegisterRoutes initializes the api endpoints and maps the requests to specific functions
@@ -31,15 +28,91 @@ func RegisterRoutes(router *mux.Router) error {
 	router.HandleFunc("/api/auth/verify", verify).Methods(http.MethodPost, http.MethodOptions)
 	router.HandleFunc("/api/auth/sendreset", sendReset).Methods(http.MethodPost, http.MethodOptions)
 	router.HandleFunc("/api/auth/resetpw", resetPassword).Methods(http.MethodPost, http.MethodOptions)
-
-	// Load sendgrid credentials
-	err := godotenv.Load()
+	router.HandleFunc("/api/auth/refresh", refresh).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/signin/mfa", signinMFA).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/magiclink", sendMagicLink).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/magiclink/consume", consumeMagicLink).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/email/confirm", confirmEmailChange).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/account/deletions/{jobId}", getDeletionStatus).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/api/auth/oidc/providers", listOIDCProviders).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/api/auth/oidc/{provider}/login", oidcLogin).Methods(http.MethodGet)
+	router.HandleFunc("/api/auth/oidc/{provider}/callback", oidcCallback).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/webauthn/login/begin", beginPasskeyLogin).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/auth/webauthn/login/finish", finishPasskeyLogin).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/oauth/token", token).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/introspect", introspect).Methods(http.MethodPost)
+	router.HandleFunc("/.well-known/jwks.json", getJWKS).Methods(http.MethodGet)
+
+	// Routes that need a logged in user
+	protected := router.NewRoute().Subrouter()
+	protected.Use(authn.Middleware(localVerifier{}))
+	protected.HandleFunc("/api/auth/events", listEvents).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api/auth/sessions/revoke-all", revokeAllSessions).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api/auth/sessions", listSessions).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api/auth/sessions/{id}", revokeSession).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api/auth/mfa/totp/enroll", enrollTOTP).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api/auth/mfa/totp/confirm", confirmTOTP).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api/auth/email", changeEmail).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api/auth/account", deleteAccount).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api/auth/apikeys", listAPIKeys).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api/auth/apikeys", createAPIKey).Methods(http.MethodPost)
+	protected.HandleFunc("/api/auth/apikeys/{keyId}", revokeAPIKey).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api/auth/webauthn/register/begin", beginPasskeyRegistration).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api/auth/webauthn/register/finish", finishPasskeyRegistration).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/api/auth/webauthn/credentials", listPasskeys).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api/auth/webauthn/credentials/{credentialId}", deletePasskey).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api/auth/oauth/clients", listOAuthClients).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api/auth/oauth/clients", registerOAuthClient).Methods(http.MethodPost)
+	protected.HandleFunc("/api/auth/oauth/clients/{clientId}", deleteOAuthClient).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api/auth/oauth/grants", listOAuthGrants).Methods(http.MethodGet, http.MethodOptions)
+	protected.HandleFunc("/api/auth/oauth/grants/{clientId}", revokeOAuthGrant).Methods(http.MethodDelete, http.MethodOptions)
+	protected.HandleFunc("/api/auth/oidc/{provider}/link", linkOIDCProvider).Methods(http.MethodPost, http.MethodOptions)
+	protected.HandleFunc("/oauth/authorize", authorize).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	// Admin routes, each checks its permission through the shared policy
+	admin := protected.PathPrefix("/api/auth/admin").Subrouter()
+	admin.Handle("/users/{userId}/lock", authn.Require(authn.PermLockAccounts)(http.HandlerFunc(lockAccount))).Methods(http.MethodPost, http.MethodOptions)
+	admin.Handle("/users/{userId}/unlock", authn.Require(authn.PermLockAccounts)(http.HandlerFunc(unlockAccount))).Methods(http.MethodPost, http.MethodOptions)
+	admin.Handle("/users/{userId}/roles", authn.Require(authn.PermManageRoles)(http.HandlerFunc(getRoles))).Methods(http.MethodGet, http.MethodOptions)
+	admin.Handle("/users/{userId}/roles", authn.Require(authn.PermManageRoles)(http.HandlerFunc(setRoles))).Methods(http.MethodPut)
+
+	if url := os.Getenv("POSTS_SERVICE_URL"); url != "" {
+		postsServiceURL = url
+	}
+	if url := os.Getenv("PROFILES_SERVICE_URL"); url != "" {
+		profilesServiceURL = url
+	}
+	internalAPIKey = os.Getenv("INTERNAL_API_KEY")
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		webauthnRPID = rpID
+	}
+	if origin := os.Getenv("WEBAUTHN_ORIGIN"); origin != "" {
+		webauthnOrigin = origin
+	}
+
+	//Read the external providers users can log in with, see InitOIDCProviders
+	err := InitOIDCProviders()
+	if err != nil {
+		return err
+	}
+	err = InitPasswordPolicy()
+	if err != nil {
+		return err
+	}
+	err = InitPasswordHasher()
 	if err != nil {
 		return err
 	}
 
-	sendgridKey = os.Getenv("SENDGRID_KEY")
-	sendgridClient = sendgrid.NewSendClient(sendgridKey)
+	sessionStore = NewSQLSessionStore(DB)
+	tokenService = NewTokenService(DB)
+
+	//Keep the rate limit counters in the database unless told otherwise, so that they hold across replicas
+	if os.Getenv("RATE_LIMIT_STORE") == "memory" {
+		InitRateLimiters(NewMemoryAttemptStore())
+	} else {
+		InitRateLimiters(NewSQLAttemptStore(DB))
+	}
 	return nil
 }
 
@@ -77,10 +150,14 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400", http.StatusBadRequest)
 		return
 	}
+	if !checkPassword(w, credentials.Password) {
+		return
+	}
 
 
 	//Check boolean returned from query
 	if exists == true {
+		recordEvent(r, eventSignup, "", outcomeFailure)
 		http.Error(w, errors.New("this username is taken").Error(), http.StatusConflict)
 		return
 	}
@@ -99,6 +176,7 @@ func signup(w http.ResponseWriter, r *http.Request) {
 	//Check boolean returned from query
 	// YOUR CODE HERE
 	if exists == true {
+		recordEvent(r, eventSignup, "", outcomeFailure)
 		http.Error(w, errors.New("this email is taken").Error(), http.StatusConflict)
 		return
 	}
@@ -106,7 +184,7 @@ func signup(w http.ResponseWriter, r *http.Request) {
 
 	//Hash the password using bcrypt and store the hashed password in a variable
 	// YOUR CODE HERE
-	bytes, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	bytes, err := hashPassword(credentials.Password)
 
 	//Check for errors during hashing process
 	// YOUR CODE HERE
@@ -122,13 +200,8 @@ func signup(w http.ResponseWriter, r *http.Request) {
 	strUUID := uuid.New().String()
 
 
-	//Create new verification token with the default token size (look at GetRandomBase62 and our constants)
-	// YOUR CODE HERE
-	verificationToken := GetRandomBase62(verifyTokenSize)
-
-
 	//Store credentials in database
-	_, err = DB.Query("INSERT INTO users (username, email, hashedPassword, verified, resetToken, verifiedToken, userID) VALUES (?, ?, ?, FALSE, NULL, ?, ?)", credentials.Username, credentials.Email, bytes, verificationToken, strUUID)
+	_, err = DB.Exec("INSERT INTO users (username, email, hashedPassword, verified, userID) VALUES (?, ?, ?, FALSE, ?)", credentials.Username, credentials.Email, bytes, strUUID)
 
 	//Check for errors in storing the credentials
 	// YOUR CODE HERE
@@ -137,69 +210,25 @@ func signup(w http.ResponseWriter, r *http.Request) {
 		log.Print(err.Error())
 		return
 	}
+	recordEvent(r, eventSignup, strUUID, outcomeSuccess)
 
 
-	//Generate an access token, expiry dates are in Unix time
-	accessExpiresAt := time.Now().Add(DefaultAccessJWTExpiry)
-	var accessToken string
-	accessToken, err = setClaims(AuthClaims{
-		UserID: strUUID,
-		StandardClaims: jwt.StandardClaims{
-			Subject:   "access",
-			ExpiresAt: accessExpiresAt.Unix(),
-			Issuer:    defaultJWTIssuer,
-			IssuedAt:  time.Now().Unix(),
-		},
-	})
-
-	//Check for error in generating an access token
-	// YOUR CODE HERE
+	//Generate an access and refresh token and set them as cookies
+	err = issueTokens(w, r, strUUID, "")
 	if err != nil {
-		http.Error(w, errors.New("error generating an access token").Error(), http.StatusInternalServerError)
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
 	}
 
-
-	//Set the cookie, name it "access_token"
-	http.SetCookie(w, &http.Cookie{
-		Name:    "access_token",
-		Value:   accessToken,
-		Expires: accessExpiresAt,
-		// Leave these next three values commented for now
-		// Secure: true,
-		// HttpOnly: true,
-		// SameSite: http.SameSiteNoneMode,
-		Path: "/",
-	})
-
-	//Generate refresh token
-	var refreshExpiresAt = time.Now().Add(DefaultRefreshJWTExpiry)
-	var refreshToken string
-	refreshToken, err = setClaims(AuthClaims{
-		UserID: strUUID,
-		StandardClaims: jwt.StandardClaims{
-			Subject:   "refresh",
-			ExpiresAt: refreshExpiresAt.Unix(),
-			Issuer:    defaultJWTIssuer,
-			IssuedAt:  time.Now().Unix(),
-		},
-	})
-
+	//Create new verification token, only its hash is stored
+	verificationToken, err := tokenService.Issue(purposeVerifyEmail, strUUID, verifyTokenTTL)
 	if err != nil {
-		http.Error(w, errors.New("error creating refreshToken").Error(), http.StatusInternalServerError)
+		http.Error(w, errors.New("error creating verification token").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
 	}
 
-	//set the refresh token ("refresh_token") as a cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "refresh_token",
-		Value:   refreshToken,
-		Expires: refreshExpiresAt,
-		Path: "/",
-	})
-
 	// Send verification email
 	err = SendEmail(credentials.Email, "Email Verification", "user-signup.html", map[string]interface{}{"Token": verificationToken})
 	if err != nil {
@@ -242,12 +271,24 @@ func signin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Refuse to check the password while the address or the account is locked out
+	limits := []limitKey{
+		{ipLimiter, "signin:ip:" + clientIP(r)},
+		{accountLimiter, "signin:user:" + credentials.Username},
+	}
+	if !checkLimits(w, limits...) {
+		recordEvent(r, eventSignin, "", outcomeBlocked)
+		return
+	}
+
 	//Get the hashedPassword and userId of the user
 	var hashedPassword, userID string
 	err := DB.QueryRow("SELECT hashedPassword, userID FROM users WHERE username = ?", credentials.Username).Scan(&hashedPassword, &userID)
 	// process errors associated with emails
 	if err != nil {
 		if err == sql.ErrNoRows {
+			recordAttempts(limits...)
+			recordEvent(r, eventSignin, "", outcomeFailure)
 			http.Error(w, errors.New("this email is not associated with an account").Error(), http.StatusNotFound)
 		} else {
 			http.Error(w, errors.New("error retrieving information with this email").Error(), http.StatusInternalServerError)
@@ -260,90 +301,99 @@ func signin(w http.ResponseWriter, r *http.Request) {
 	// "YOUR CODE HERE"
 	// temp, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(credentials.Password))
+	match, rehash, err := verifyPassword(hashedPassword, credentials.Password)
 	// match := !(hashedPassword == string(temp))
 
 	//Check error in comparing hashed passwords
 	// "YOUR CODE HERE"
 	if err != nil {
-		http.Error(w, errors.New("password entered does not match records").Error(), http.StatusInternalServerError)
+		http.Error(w, errors.New("error checking password").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
 	}
-
-	//Generate an access token  and set it as a cookie (Look at signup and feel free to copy paste!)
-	// "YOUR CODE HERE"
-	accessExpiresAt := time.Now().Add(DefaultAccessJWTExpiry)
-	var accessToken string
-	accessToken, err = setClaims(AuthClaims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			Subject:   "access",
-			ExpiresAt: accessExpiresAt.Unix(),
-			Issuer:    defaultJWTIssuer,
-			IssuedAt:  time.Now().Unix(),
-		},
-	})
-	if err != nil {
-		http.Error(w, errors.New("error generating an access token").Error(), http.StatusInternalServerError)
-		log.Print(err.Error())
+	if !match {
+		recordAttempts(limits...)
+		recordEvent(r, eventSignin, userID, outcomeFailure)
+		http.Error(w, errors.New("password entered does not match records").Error(), http.StatusInternalServerError)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:    "access_token",
-		Value:   accessToken,
-		Expires: accessExpiresAt,
-		// Leave these next three values commented for now
-		// Secure: true,
-		// HttpOnly: true,
-		// SameSite: http.SameSiteNoneMode,
-		Path: "/",
-	})
-
 
+	//The hash was made with older settings, replace it now that we have the password
+	if rehash {
+		upgradePasswordHash(userID, hashedPassword, credentials.Password)
+	}
 
+	//The password was right, forget the failed attempts on the account
+	err = accountLimiter.Reset("signin:user:" + credentials.Username)
+	if err != nil {
+		log.Print(err.Error())
+	}
 
-	//Generate a refresh token and set it as a cookie (Look at signup and feel free to copy paste!)
-	// "YOUR CODE HERE"
-	var refreshExpiresAt = time.Now().Add(DefaultRefreshJWTExpiry)
-	var refreshToken string
-	refreshToken, err = setClaims(AuthClaims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			Subject:   "refresh",
-			ExpiresAt: refreshExpiresAt.Unix(),
-			Issuer:    defaultJWTIssuer,
-			IssuedAt:  time.Now().Unix(),
-		},
-	})
+	//Generate an access and refresh token and set them as cookies, unless a second factor is needed first
+	pending, err := finishSignin(w, r, userID)
+	if err == errAccountLocked {
+		recordEvent(r, eventSignin, userID, outcomeBlocked)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(w, errors.New("error creating refreshToken").Error(), http.StatusInternalServerError)
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:    "refresh_token",
-		Value:   refreshToken,
-		Expires: refreshExpiresAt,
-		Path: "/",
-	})
+	//With a second factor the sign in only counts once signinMFA accepts the code
+	if pending {
+		recordEvent(r, eventSignin, userID, outcomeMFARequired)
+		return
+	}
+	recordEvent(r, eventSignin, userID, outcomeSuccess)
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 	if (*r).Method == "OPTIONS" {
 		return
 	}
 
+	//Revoke the current session on the server so the tokens stop working even if they were copied
+	var userID string
+	for _, name := range []string{"access_token", "refresh_token"} {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			continue
+		}
+		claims, err := getClaims(cookie.Value)
+		if err != nil {
+			continue
+		}
+		userID = claims.UserID
+		if claims.Id != "" {
+			err = sessionStore.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0))
+			if err != nil {
+				http.Error(w, errors.New("error revoking token").Error(), http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+		if claims.SessionID != "" {
+			err = revokeTokenFamily(claims.SessionID)
+			if err != nil {
+				http.Error(w, errors.New("error revoking session").Error(), http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+	}
+
 	// logging out causes expiration time of cookie to be set to now
 
 	//Set the access_token and refresh_token to have an empty value and set their expiration date to anytime in the past
-	var expiresAt = time.Now().Add(-1 * time.Hour)
-	http.SetCookie(w, &http.Cookie{Name: "access_token", Value: "", Expires: expiresAt})
-	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: "", Expires: expiresAt})
+	expireCookies(w)
+	recordEvent(r, eventLogout, userID, outcomeSuccess)
 	return
 }
 
@@ -365,29 +415,26 @@ func verify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Obtain the user with the verifiedToken from the query parameter and set their verification status to the integer "1"
-	log.Println(token[0])
-	// _, err := DB.Query("SELECT * FROM users WHERE verifiedToken = ?", token[0])
-	res, err := DB.Exec("UPDATE users SET verified = 1 WHERE verifiedToken = ?", token[0])
+	//Redeem the token from the query parameter and set the verification status of its user to the integer "1"
+	userID, err := tokenService.Consume(purposeVerifyEmail, token[0])
+	if err == errTokenInvalid {
+		recordEvent(r, eventVerifyEmail, "", outcomeFailure)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming verification token").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
 
-	//Check for errors in executing the previous query
-	// "YOUR CODE HERE"
+	_, err = DB.Exec("UPDATE users SET verified = 1 WHERE userId = ?", userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, errors.New("error verifying user").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
-	} else {
-		n, error := res.RowsAffected()
-		if error != nil {
-			http.Error(w, error.Error(), http.StatusBadRequest)
-			log.Print(error.Error())
-			return
-		}
-		if n == 0 {
-			http.Error(w, "400", http.StatusBadRequest)
-			return
-		}
 	}
+	recordEvent(r, eventVerifyEmail, userID, outcomeSuccess)
 
 	return
 }
@@ -428,16 +475,34 @@ func sendReset(w http.ResponseWriter, r *http.Request) {
 	}
 
 
-	//generate reset token
-	token := GetRandomBase62(resetTokenSize)
+	//Every request counts, whether or not the email has an account
+	limits := []limitKey{
+		{ipLimiter, "sendreset:ip:" + clientIP(r)},
+		{resetLimiter, "sendreset:email:" + credentials.Email},
+	}
+	if !checkLimits(w, limits...) {
+		recordEvent(r, eventSendReset, "", outcomeBlocked)
+		return
+	}
+	recordAttempts(limits...)
 
-	//Obtain the user with the specified email and set their resetToken to the token we generated
-	_, err := DB.Query("UPDATE users SET resetToken = ? WHERE email = ?", token, credentials.Email)
+	//Obtain the user with the specified email, don't let on whether the email has an account
+	var userID string
+	err := DB.QueryRow("SELECT userId FROM users WHERE email = ?", credentials.Email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		recordEvent(r, eventSendReset, "", outcomeFailure)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error retrieving user with this email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
 
-	//Check for errors executing the queries
-	// "YOUR CODE HERE"
+	//generate reset token, only its hash is stored
+	token, err := tokenService.Issue(purposeResetPassword, userID, resetTokenTTL)
 	if err != nil {
-		http.Error(w, errors.New("error in storing resetToken through query").Error(), http.StatusInternalServerError)
+		http.Error(w, errors.New("error creating reset token").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
 	}
@@ -449,6 +514,7 @@ func sendReset(w http.ResponseWriter, r *http.Request) {
 		log.Print(err.Error())
 		return
 	}
+	recordEvent(r, eventSendReset, userID, outcomeSuccess)
 	return
 }
 
@@ -490,32 +556,46 @@ func resetPassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 
-	email := credentials.Email
 	username := credentials.Username
 	password := credentials.Password
-	var exists bool
-	//check if the username and token pair exist
-	err := DB.QueryRow("SELECT EXISTS(SELECT * FROM users WHERE username = ? AND resetToken = ?)", username, token).Scan(&exists)
-	
-	//Check for errors executing the query
-	// "YOUR CODE HERE"
-	if err != nil {
-		http.Error(w, errors.New("error in checking username and token pair").Error(), http.StatusInternalServerError)
+
+	//Check the new password before the token is used up, so a rejected one can be retried
+	if !checkPassword(w, password) {
+		return
+	}
+
+	//Get the user the username belongs to
+	var userID string
+	err := DB.QueryRow("SELECT userId FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, errors.New("error retrieving user").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
 	}
 
-	//Check exists boolean. Call an error if the username-token pair doesn't exist
-	// "YOUR CODE HERE"
-	if !exists {
+	//Redeem the token, it has to have been issued to the same user. One issued to someone
+	//else stays usable, so a mistyped username doesn't burn the link.
+	err = tokenService.ConsumeFor(purposeResetPassword, token, userID)
+	if err == errTokenInvalid {
+		recordEvent(r, eventResetPassword, userID, outcomeFailure)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == errTokenWrongUser {
+		recordEvent(r, eventResetPassword, userID, outcomeFailure)
 		http.Error(w, errors.New("this username-token pair does not exist").Error(), http.StatusConflict)
 		return
 	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming reset token").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
 
 
 	//Hash the new password
 	// "YOUR CODE HERE"
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	bytes, err := hashPassword(password)
 
 	//Check for errors in hashing the new password
 	// "YOUR CODE HERE"
@@ -525,25 +605,22 @@ func resetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//input new password and clear the reset token (set the token equal to empty string)
-	res, err := DB.Exec("UPDATE users SET hashedPassword = ? AND resetToken = ? WHERE email = ?", bytes, "", email)
+	//input new password
+	_, err = DB.Exec("UPDATE users SET hashedPassword = ? WHERE userId = ?", bytes, userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, errors.New("error storing new password").Error(), http.StatusInternalServerError)
 		log.Print(err.Error())
-	} else {
-		n, error := res.RowsAffected()
-		if error != nil {
-			http.Error(w, error.Error(), http.StatusBadRequest)
-			log.Print(error.Error())
-			return
-		}
-		if n == 0 {
-			http.Error(w, "400", http.StatusBadRequest)
-			return
-		}
+		return
 	}
 
-	//put the user in the redis cache to invalidate all current sessions (NOT IN SCOPE FOR PROJECT), leave this comment for future reference
+	//invalidate all current sessions, whoever had the old password may still be logged in
+	err = sessionStore.RevokeAllSessions(userID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	recordEvent(r, eventResetPassword, userID, outcomeSuccess)
 
 	return
 }
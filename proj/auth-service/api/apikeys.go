@@ -0,0 +1,208 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errAPIKeyInvalid = errors.New("API key is not valid")
+
+	//apiKeyTouchInterval is how stale lastUsedAt may get, so busy keys don't write on every request
+	apiKeyTouchInterval = time.Minute
+)
+
+//apiKeySize is the number of random characters after the prefix
+const apiKeySize = 40
+
+//APIKey describes a key without the secret, which is only shown once when it is created
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Key        string     `json:"key,omitempty"`
+}
+
+//createAPIKey mints a named key with the requested scopes for the logged in user
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding API key from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if len(request.Name) < 1 || len(request.Name) > 64 || len(request.Scopes) < 1 {
+		http.Error(w, "400", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !authn.ValidScope(scope) {
+			http.Error(w, errors.New("unknown scope "+scope).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	//Only a hash is stored, the key itself is shown this once
+	key := authn.APIKeyPrefix + GetRandomBase62(apiKeySize)
+	apiKey := APIKey{
+		ID:        uuid.New().String(),
+		Name:      request.Name,
+		Prefix:    key[:len(authn.APIKeyPrefix)+6],
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now(),
+		Key:       key,
+	}
+	_, err = DB.Exec("INSERT INTO api_keys (keyId, userId, name, prefix, keyHash, scopes, createdAt, lastUsedAt, revokedAt) VALUES (?, ?, ?, ?, ?, ?, ?, NULL, NULL)",
+		apiKey.ID, claims.UserID, apiKey.Name, apiKey.Prefix, hashToken(key), strings.Join(apiKey.Scopes, " "), apiKey.CreatedAt)
+	if err != nil {
+		http.Error(w, errors.New("error creating API key").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKey)
+}
+
+//listAPIKeys returns the active keys of the logged in user
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	rows, err := DB.Query("SELECT keyId, name, prefix, scopes, createdAt, lastUsedAt FROM api_keys WHERE userId = ? AND revokedAt IS NULL ORDER BY createdAt", claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving API keys").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var lastUsedAt sql.NullTime
+		err = rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &lastUsedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving API keys").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		key.Scopes = strings.Fields(scopes)
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+//revokeAPIKey stops one of the logged in user's keys from working
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	keyID := mux.Vars(r)["keyId"]
+
+	res, err := DB.Exec("UPDATE api_keys SET revokedAt = ? WHERE keyId = ? AND userId = ? AND revokedAt IS NULL", time.Now(), keyID, claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking API key").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, errors.New("error revoking API key").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if n == 0 {
+		http.Error(w, errors.New("this API key does not exist").Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//verifyAPIKey returns the claims a request made with the key acts with. They carry the
+//key's scopes but no roles, a key never gets more than its scopes allow.
+func verifyAPIKey(key string) (*AuthClaims, error) {
+	var keyID, userID, scopes, email string
+	var verified, locked bool
+	var lastUsedAt sql.NullTime
+	err := DB.QueryRow("SELECT k.keyId, k.userId, k.scopes, k.lastUsedAt, u.email, u.verified, u.locked FROM api_keys k JOIN users u ON u.userId = k.userId WHERE k.keyHash = ? AND k.revokedAt IS NULL", hashToken(key)).
+		Scan(&keyID, &userID, &scopes, &lastUsedAt, &email, &verified, &locked)
+	if err == sql.ErrNoRows || (err == nil && locked) {
+		return nil, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !lastUsedAt.Valid || now.Sub(lastUsedAt.Time) > apiKeyTouchInterval {
+		_, err = DB.Exec("UPDATE api_keys SET lastUsedAt = ? WHERE keyId = ?", now, keyID)
+		if err != nil {
+			log.Print("error updating API key last use: " + err.Error())
+		}
+	}
+
+	return &AuthClaims{
+		Email:         email,
+		EmailVerified: verified,
+		UserID:        userID,
+		Scopes:        strings.Fields(scopes),
+		StandardClaims: jwt.StandardClaims{
+			Id:       keyID,
+			Subject:  authn.SubjectAPIKey,
+			Issuer:   defaultJWTIssuer,
+			IssuedAt: now.Unix(),
+		},
+	}, nil
+}
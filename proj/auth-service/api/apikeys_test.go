@@ -0,0 +1,134 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/gorilla/mux"
+)
+
+//createTestAPIKey creates a key with the scopes for the user and returns the response
+func createTestAPIKey(t *testing.T, user testUser, scopes ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	return request(t, http.MethodPost, "/api/auth/apikeys", map[string]interface{}{"name": "test key", "scopes": scopes}, user.Cookies...)
+}
+
+//scopedService is a service with a read and a write route, protected the way posts
+//protects its routes and checking tokens with this auth-service
+func scopedService(t *testing.T) *httptest.Server {
+	t.Helper()
+	auth := httptest.NewServer(testRouter)
+	t.Cleanup(auth.Close)
+
+	router := mux.NewRouter()
+	router.Use(authn.Middleware(authn.NewRemoteVerifier(auth.URL)))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router.Handle("/read", authn.RequireScope(authn.ScopePostsRead)(ok))
+	router.Handle("/write", authn.RequireScope(authn.ScopePostsWrite)(ok))
+	service := httptest.NewServer(router)
+	t.Cleanup(service.Close)
+	return service
+}
+
+//callWith calls the route of the service with the bearer token
+func callWith(t *testing.T, service *httptest.Server, path string, token string) int {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, service.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "apikey")
+	w := createTestAPIKey(t, user, authn.ScopePostsRead)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+	var key APIKey
+	decode(t, w, &key)
+	if !authn.IsAPIKey(key.Key) {
+		t.Fatalf("got key %q, want it to start with %s", key.Key, authn.APIKeyPrefix)
+	}
+
+	//A key only gets its scopes, the user's own login isn't limited
+	service := scopedService(t)
+	access := cookieNamed(t, user.Cookies, "access_token").Value
+	for _, c := range []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/read", key.Key, http.StatusOK},
+		{"/write", key.Key, http.StatusForbidden},
+		{"/read", access, http.StatusOK},
+		{"/write", access, http.StatusOK},
+		{"/read", authn.APIKeyPrefix + "made up", http.StatusUnauthorized},
+	} {
+		if got := callWith(t, service, c.path, c.token); got != c.want {
+			t.Errorf("%s with %.10s: got %d, want %d", c.path, c.token, got, c.want)
+		}
+	}
+
+	//Keys can't be used to manage the account, e.g. to mint a key with more scopes
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/apikeys", nil)
+	r.Header.Set("Authorization", "Bearer "+key.Key)
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("managing keys with a key: got %d, want 401", w.Code)
+	}
+}
+
+func TestAPIKeyRejectsBadScopes(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "apikeybad")
+	for name, scopes := range map[string][]string{
+		"no scopes":     nil,
+		"unknown scope": {"admin"},
+	} {
+		if w := createTestAPIKey(t, user, scopes...); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", name, w.Code)
+		}
+	}
+}
+
+func TestAPIKeyListAndRevoke(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "apikeylist")
+	var key APIKey
+	decode(t, createTestAPIKey(t, user, authn.ScopePostsRead, authn.ScopeProfileRead), &key)
+
+	//The list shows what the key is for, never the key itself
+	w := request(t, http.MethodGet, "/api/auth/apikeys", nil, user.Cookies...)
+	var keys []APIKey
+	decode(t, w, &keys)
+	if len(keys) != 1 || keys[0].ID != key.ID || keys[0].Key != "" || len(keys[0].Scopes) != 2 {
+		t.Fatalf("got %+v", keys)
+	}
+	if !introspectActive(t, key.Key) {
+		t.Fatal("the key is not active")
+	}
+
+	//Only the owner can revoke it
+	other := signupUser(t, "apikeyother")
+	if w := request(t, http.MethodDelete, "/api/auth/apikeys/"+key.ID, nil, other.Cookies...); w.Code != http.StatusNotFound {
+		t.Errorf("revoked by someone else: got %d, want 404", w.Code)
+	}
+	if w := request(t, http.MethodDelete, "/api/auth/apikeys/"+key.ID, nil, user.Cookies...); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: got %d %s", w.Code, w.Body.String())
+	}
+	if introspectActive(t, key.Key) {
+		t.Error("the revoked key is still active")
+	}
+}
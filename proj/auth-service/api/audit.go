@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+)
+
+//Audited events
+const (
+	eventSignup        = "signup"
+	eventSignin        = "signin"
+	eventLogout        = "logout"
+	eventVerifyEmail   = "verify_email"
+	eventSendReset     = "send_reset"
+	eventResetPassword = "reset_password"
+)
+
+//Event outcomes. Blocked is a request turned away before it was checked, by the rate
+//limiter or because the account is locked. MFA required is a right password of a user
+//with a second factor, signinMFA records how that sign in ended.
+const (
+	outcomeSuccess     = "success"
+	outcomeFailure     = "failure"
+	outcomeBlocked     = "blocked"
+	outcomeMFARequired = "mfa_required"
+)
+
+const (
+	defaultEventPage = 50
+	maxEventPage     = 200
+)
+
+//AuthEvent is one entry of the audit log
+type AuthEvent struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	UserID    string    `json:"userId"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+//eventPage is a page of events, pass nextCursor as before to get the next one
+type eventPage struct {
+	Events     []AuthEvent `json:"events"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+//recordEvent appends an event to the audit log. userID is empty when the request didn't
+//get far enough to know the user. Failing to write is logged but doesn't fail the request.
+func recordEvent(r *http.Request, eventType string, userID string, outcome string) {
+	_, err := DB.Exec("INSERT INTO auth_events (eventType, userId, ip, userAgent, outcome, createdAt) VALUES (?, ?, ?, ?, ?, ?)",
+		eventType, userID, clientIP(r), requestUserAgent(r), outcome, time.Now())
+	if err != nil {
+		log.Printf("error recording %s event: %s", eventType, err.Error())
+	}
+}
+
+//listEvents returns the audit log newest first, a page at a time. Users see their own
+//events. Admins see everyone's and can filter by userId.
+func listEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	query := r.URL.Query()
+
+	limit := defaultEventPage
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, errors.New("limit must be a positive number").Error(), http.StatusBadRequest)
+			return
+		}
+		if n < maxEventPage {
+			limit = n
+		} else {
+			limit = maxEventPage
+		}
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+	if authn.Allowed(claims, authn.PermViewAuditLog) {
+		if userID := query.Get("userId"); userID != "" {
+			conditions = append(conditions, "userId = ?")
+			args = append(args, userID)
+		}
+	} else {
+		conditions = append(conditions, "userId = ?")
+		args = append(args, claims.UserID)
+	}
+	if eventType := query.Get("type"); eventType != "" {
+		conditions = append(conditions, "eventType = ?")
+		args = append(args, eventType)
+	}
+	if before := query.Get("before"); before != "" {
+		cursor, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			http.Error(w, errors.New("before is not a valid cursor").Error(), http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "eventId < ?")
+		args = append(args, cursor)
+	}
+
+	statement := "SELECT eventId, eventType, userId, ip, userAgent, outcome, createdAt FROM auth_events"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	//Ask for one extra row to know whether there is a next page
+	statement += " ORDER BY eventId DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := DB.Query(statement, args...)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving events").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	page := eventPage{Events: []AuthEvent{}}
+	for rows.Next() {
+		var event AuthEvent
+		err = rows.Scan(&event.ID, &event.Type, &event.UserID, &event.IP, &event.UserAgent, &event.Outcome, &event.CreatedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving events").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		page.Events = append(page.Events, event)
+	}
+	if len(page.Events) > limit {
+		page.Events = page.Events[:limit]
+		page.NextCursor = strconv.FormatInt(page.Events[limit-1].ID, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
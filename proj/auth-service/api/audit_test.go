@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+//signinOutcomes returns the outcomes of the user's signin events, oldest first
+func signinOutcomes(t *testing.T, userID string) []string {
+	t.Helper()
+	rows, err := DB.Query("SELECT outcome FROM auth_events WHERE eventType = ? AND userId = ? ORDER BY eventId", eventSignin, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	outcomes := []string{}
+	for rows.Next() {
+		var outcome string
+		err = rows.Scan(&outcome)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
+}
+
+//anonymousFailures counts the failed signins that didn't get as far as a user
+func anonymousFailures(t *testing.T) int {
+	t.Helper()
+	var n int
+	err := DB.QueryRow("SELECT COUNT(*) FROM auth_events WHERE eventType = ? AND userId = '' AND outcome = ?", eventSignin, outcomeFailure).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func equalOutcomes(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMagicLinkSigninIsAudited(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "auditlink")
+	w := request(t, http.MethodPost, "/api/auth/magiclink", Credentials{Email: user.Email})
+	if w.Code != http.StatusOK {
+		t.Fatalf("magic link: got %d %s", w.Code, w.Body.String())
+	}
+	email, _ := testMailer.Last(user.Email)
+	token, _ := email.Data["Token"].(string)
+
+	w = request(t, http.MethodPost, "/api/auth/magiclink/consume?token="+token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("consume: got %d %s", w.Code, w.Body.String())
+	}
+	before := anonymousFailures(t)
+	w = request(t, http.MethodPost, "/api/auth/magiclink/consume?token="+token, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("consume again: got %d %s, want 400", w.Code, w.Body.String())
+	}
+
+	if got := signinOutcomes(t, user.UserID); !equalOutcomes(got, outcomeSuccess) {
+		t.Errorf("got %v, want one successful signin", got)
+	}
+	if anonymousFailures(t) != before+1 {
+		t.Error("the used link was not recorded as a failed signin")
+	}
+}
+
+func TestOIDCSigninIsAudited(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+	userID := loggedInAs(t, p.login(t, "/api/auth/oidc/mock/callback"))
+	if got := signinOutcomes(t, userID); !equalOutcomes(got, outcomeSuccess) {
+		t.Errorf("got %v, want one successful signin", got)
+	}
+
+	before := anonymousFailures(t)
+	p.nonce = "replayed"
+	p.login(t, "/api/auth/oidc/mock/callback")
+	if anonymousFailures(t) != before+1 {
+		t.Error("the bad ID token was not recorded as a failed signin")
+	}
+}
+
+func TestPasskeySigninIsAudited(t *testing.T) {
+	user, a := registeredAuthenticator(t, "auditpk")
+	if resp := a.login(t); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got %d", resp.StatusCode)
+	}
+	a.signCount = 0
+	if resp := a.login(t); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("login with a repeated counter: got %d, want 401", resp.StatusCode)
+	}
+	if got := signinOutcomes(t, user.UserID); !equalOutcomes(got, outcomeSuccess, outcomeFailure) {
+		t.Errorf("got %v, want a success and then a failure", got)
+	}
+}
@@ -28,7 +28,7 @@ func InitDB() *sql.DB {
 	username := "root"
 	password := "root"
 	ipAddress := "tcp(172.28.1.2:3306)"
-	dbName := "/auth"
+	dbName := "/auth?parseTime=true"
 	// "YOUR CODE HERE"
 	// DB, err = sql.Open("mysql", "root:root@tcp(172.28.1.3:3306)/postsDB?parseTime=true")
 	DB, err = sql.Open(dbType, username+":"+password+"@"+ipAddress+dbName)
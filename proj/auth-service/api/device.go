@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+//maxUserAgent is the size of the userAgent columns
+const maxUserAgent = 255
+
+//userAgentMatch maps a User-Agent token to the name we show
+type userAgentMatch struct {
+	token string
+	name  string
+}
+
+//browsers and systems are checked in order, since most browsers also claim to be the
+//ones before them, e.g. Edge says Chrome and Safari and Chrome says Safari
+var (
+	browsers = []userAgentMatch{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"Go-http-client/", "Go client"},
+	}
+	systems = []userAgentMatch{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Macintosh", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+//requestUserAgent returns the User-Agent of the request, cut to fit its column
+func requestUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+	return userAgent
+}
+
+//deviceName turns a User-Agent into something a user recognizes, like "Firefox on Windows"
+func deviceName(userAgent string) string {
+	browser := matchUserAgent(userAgent, browsers)
+	system := matchUserAgent(userAgent, systems)
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+func matchUserAgent(userAgent string, matches []userAgentMatch) string {
+	for _, match := range matches {
+		if strings.Contains(userAgent, match.token) {
+			return match.name
+		}
+	}
+	return ""
+}
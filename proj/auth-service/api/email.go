@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/google/uuid"
+)
+
+//changeEmail starts an email change for the logged in user. Nothing changes until the
+//link sent to the new address is followed, the old address is told about the request.
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	credentials := Credentials{}
+	err := json.NewDecoder(r.Body).Decode(&credentials)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding credentials from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	if !strings.Contains(credentials.Email, "@") {
+		http.Error(w, "400", http.StatusBadRequest)
+		return
+	}
+
+	//A stolen access token alone shouldn't be enough to take over the account
+	limits := []limitKey{{accountLimiter, "email:user:" + claims.UserID}}
+	if !checkLimits(w, limits...) {
+		return
+	}
+
+	if !reauthenticate(w, claims, credentials.Password, limits...) {
+		return
+	}
+
+	var oldEmail string
+	err = DB.QueryRow("SELECT email FROM users WHERE userId = ?", claims.UserID).Scan(&oldEmail)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	if credentials.Email == oldEmail {
+		http.Error(w, errors.New("this is already your email").Error(), http.StatusBadRequest)
+		return
+	}
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT * FROM users WHERE email = ?)", credentials.Email).Scan(&exists)
+	if err != nil {
+		http.Error(w, errors.New("error checking if email exists").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if exists == true {
+		http.Error(w, errors.New("this email is taken").Error(), http.StatusConflict)
+		return
+	}
+
+	token, err := tokenService.IssueWithData(purposeChangeEmail, claims.UserID, credentials.Email, changeEmailTokenTTL)
+	if err != nil {
+		http.Error(w, errors.New("error creating confirmation token").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	err = SendEmail(credentials.Email, "Confirm your new email", "email-change.html", map[string]interface{}{"Token": token})
+	if err != nil {
+		http.Error(w, errors.New("error sending confirmation email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	err = SendEmail(oldEmail, "Your BearChat email is being changed", "email-change-notice.html", map[string]interface{}{"NewEmail": credentials.Email})
+	if err != nil {
+		http.Error(w, errors.New("error sending notice email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+//confirmEmailChange redeems the link sent to the new address and makes the change
+func confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, errors.New("Url Param 'token' is missing").Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, newEmail, err := tokenService.Lookup(purposeChangeEmail, token)
+	if err == errTokenInvalid {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming confirmation token").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	//Someone may have signed up with the address since the link was sent. That is checked
+	//before the token is used up, so the link still works once the address is free again.
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT * FROM users WHERE email = ? AND userId <> ?)", newEmail, userID).Scan(&exists)
+	if err != nil {
+		http.Error(w, errors.New("error checking if email exists").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if exists == true {
+		http.Error(w, errors.New("this email is taken").Error(), http.StatusConflict)
+		return
+	}
+
+	//Following the link proves the user owns the new address. The profiles service is
+	//told through the outbox, so it catches up even if it is down right now. The token is
+	//used up in the same transaction, so a failed update leaves the link working.
+	payload, err := json.Marshal(map[string]string{"email": newEmail})
+	if err != nil {
+		http.Error(w, errors.New("error updating email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, errors.New("error updating email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer tx.Rollback()
+	err = tokenService.ConsumeIn(tx, purposeChangeEmail, token)
+	if err == errTokenInvalid {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming confirmation token").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = tx.Exec("UPDATE users SET email = ?, verified = TRUE WHERE userId = ?", newEmail, userID)
+	if err == nil {
+		err = enqueueEvent(tx, uuid.New().String(), eventEmailChanged, targetProfiles, http.MethodPut, "/internal/profile/"+userID+"/email", string(payload))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, errors.New("error updating email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	//Access tokens carry the email, log the user out everywhere so no session keeps
+	//handing the old address to the other services
+	err = sessionStore.RevokeAllSessions(userID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+//confirmEmailLink follows the link emailed to the new address
+func confirmEmailLink(t *testing.T, newEmail string) *http.Response {
+	t.Helper()
+	email, ok := testMailer.Last(newEmail)
+	if !ok || email.Template != "email-change.html" {
+		t.Fatalf("got %+v, want the confirmation email", email)
+	}
+	token, _ := email.Data["Token"].(string)
+	return request(t, http.MethodPost, "/api/auth/email/confirm?token="+token, nil).Result()
+}
+
+func TestChangeEmail(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "chemail")
+	newEmail := "new" + user.Email
+
+	w := request(t, http.MethodPost, "/api/auth/email", Credentials{Email: newEmail, Password: "not my password"}, user.Cookies...)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d %s, want 401", w.Code, w.Body.String())
+	}
+	w = request(t, http.MethodPost, "/api/auth/email", Credentials{Email: newEmail, Password: user.Password}, user.Cookies...)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("change email: got %d %s", w.Code, w.Body.String())
+	}
+	if notice, ok := testMailer.Last(user.Email); !ok || notice.Template != "email-change-notice.html" {
+		t.Errorf("got %+v, want the notice to the old address", notice)
+	}
+
+	if resp := confirmEmailLink(t, newEmail); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm: got %d", resp.StatusCode)
+	}
+	var email string
+	err := DB.QueryRow("SELECT email FROM users WHERE userId = ?", user.UserID).Scan(&email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != newEmail {
+		t.Errorf("got email %s, want %s", email, newEmail)
+	}
+
+	//The link is used up
+	if resp := confirmEmailLink(t, newEmail); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("second confirm: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestChangeEmailWithoutPassword(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+	w := p.login(t, "/api/auth/oidc/mock/callback")
+	newEmail := "new" + p.email
+
+	w = request(t, http.MethodPost, "/api/auth/email", Credentials{Email: newEmail}, w.Result().Cookies()...)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("change email: got %d %s", w.Code, w.Body.String())
+	}
+	if resp := confirmEmailLink(t, newEmail); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm: got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Password hashing algorithms
+const (
+	algBcrypt   = "bcrypt"
+	algArgon2id = "argon2id"
+)
+
+var errUnknownHash = errors.New("password hash is in an unknown format")
+
+//passwordHasher hashes new passwords, see InitPasswordHasher
+var passwordHasher = PasswordHasher{
+	Algorithm:  algBcrypt,
+	BcryptCost: bcrypt.DefaultCost,
+	Argon2:     Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 2, SaltLength: 16, KeyLength: 32},
+}
+
+//PasswordHasher hashes passwords with the configured algorithm. Every hash records its
+//algorithm and parameters, bcrypt in its own $2a$<cost>$ format and Argon2id in the PHC
+//format $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>, so hashes made with
+//older settings keep working and can be told apart.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+//Argon2Params are the Argon2id parameters, Memory is in KiB
+type Argon2Params struct {
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+//InitPasswordHasher reads the algorithm from PASSWORD_HASH (bcrypt or argon2id) and its
+//parameters from BCRYPT_COST, ARGON2_MEMORY_KIB, ARGON2_TIME and ARGON2_THREADS. Raising
+//them is safe, existing hashes are upgraded the next time their user signs in.
+func InitPasswordHasher() error {
+	hasher := passwordHasher
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		hasher.Algorithm = algorithm
+	}
+	if hasher.Algorithm != algBcrypt && hasher.Algorithm != algArgon2id {
+		return fmt.Errorf("PASSWORD_HASH must be %s or %s", algBcrypt, algArgon2id)
+	}
+
+	//Each value is parsed with the size of its field, so a value too big for it is refused
+	//instead of wrapping around
+	for env, param := range map[string]struct {
+		bitSize int
+		set     func(uint64)
+	}{
+		"BCRYPT_COST":       {32, func(n uint64) { hasher.BcryptCost = int(n) }},
+		"ARGON2_MEMORY_KIB": {32, func(n uint64) { hasher.Argon2.Memory = uint32(n) }},
+		"ARGON2_TIME":       {32, func(n uint64) { hasher.Argon2.Time = uint32(n) }},
+		"ARGON2_THREADS":    {8, func(n uint64) { hasher.Argon2.Threads = uint8(n) }},
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, param.bitSize)
+		if err != nil || n == 0 {
+			return fmt.Errorf("%s must be a number from 1 to %d", env, uint64(1)<<param.bitSize-1)
+		}
+		param.set(n)
+	}
+	if hasher.BcryptCost < bcrypt.MinCost || hasher.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if hasher.Argon2.Threads == 0 || hasher.Argon2.Memory < 8*uint32(hasher.Argon2.Threads) {
+		return errors.New("ARGON2_MEMORY_KIB must be at least 8 KiB per thread")
+	}
+	passwordHasher = hasher
+	return nil
+}
+
+//Hash hashes the password with the current algorithm and parameters
+func (h PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == algBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+
+	p := h.Argon2
+	salt := make([]byte, p.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//Verify reports whether the password matches the hash, and whether the hash was made with
+//another algorithm or other parameters than the current ones and should be replaced. A
+//wrong password is not an error, nor is an empty hash, which accounts without a password have.
+func (h PasswordHasher) Verify(hash string, password string) (match bool, rehash bool, err error) {
+	if hash == "" {
+		return false, false, nil
+	}
+
+	if params, salt, key, ok := parseArgon2id(hash); ok {
+		actual := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(actual, key) != 1 {
+			return false, false, nil
+		}
+		current := h.Argon2
+		rehash = h.Algorithm != algArgon2id || params.Memory != current.Memory || params.Time != current.Time ||
+			params.Threads != current.Threads || uint32(len(salt)) != current.SaltLength || uint32(len(key)) != current.KeyLength
+		return true, rehash, nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, errUnknownHash
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, h.Algorithm != algBcrypt || cost != h.BcryptCost, nil
+}
+
+//parseArgon2id splits a PHC Argon2id hash into its parameters, salt and key
+func parseArgon2id(hash string) (params Argon2Params, salt []byte, key []byte, ok bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != algArgon2id || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, false
+	}
+	var threads uint32
+	n, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &threads)
+	if err != nil || n != 3 || threads == 0 || threads > 255 {
+		return params, nil, nil, false
+	}
+	params.Threads = uint8(threads)
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, false
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, false
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, true
+}
+
+//hashPassword hashes a new password with the current settings
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+//verifyPassword checks the password against a stored hash, see PasswordHasher.Verify
+func verifyPassword(hash string, password string) (match bool, rehash bool, err error) {
+	return passwordHasher.Verify(hash, password)
+}
+
+//upgradePasswordHash rehashes the password with the current settings after a successful
+//signin. It only replaces the hash the password was checked against, so a password change
+//that raced the signin wins. Failing is harmless, the old hash still works.
+func upgradePasswordHash(userID string, oldHash string, password string) {
+	hash, err := hashPassword(password)
+	if err == nil {
+		_, err = DB.Exec("UPDATE users SET hashedPassword = ? WHERE userId = ? AND hashedPassword = ?", hash, userID, oldHash)
+	}
+	if err != nil {
+		log.Print("error upgrading password hash: " + err.Error())
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//storedHash reads the password hash of the user
+func storedHash(t *testing.T, userID string) string {
+	t.Helper()
+	var hash string
+	err := DB.QueryRow("SELECT hashedPassword FROM users WHERE userId = ?", userID).Scan(&hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestInitPasswordHasherRejectsOutOfRange(t *testing.T) {
+	saved := passwordHasher
+	defer func() { passwordHasher = saved }()
+
+	//256 threads used to wrap around to 0 and 258 to 2
+	for _, threads := range []string{"0", "256", "258", "-1", "many"} {
+		t.Setenv("ARGON2_THREADS", threads)
+		if err := InitPasswordHasher(); err == nil {
+			t.Errorf("ARGON2_THREADS=%s: got no error", threads)
+		}
+	}
+	t.Setenv("ARGON2_THREADS", "255")
+	t.Setenv("ARGON2_MEMORY_KIB", "4096")
+	if err := InitPasswordHasher(); err != nil {
+		t.Fatal(err)
+	}
+	if passwordHasher.Argon2.Threads != 255 {
+		t.Errorf("got %d threads, want 255", passwordHasher.Argon2.Threads)
+	}
+}
+
+func TestSigninUpgradesPasswordHash(t *testing.T) {
+	resetLimits()
+	saved := passwordHasher
+	defer func() { passwordHasher = saved }()
+	user := signupUser(t, "rehash")
+	bcryptHash := storedHash(t, user.UserID)
+
+	passwordHasher.Algorithm = algArgon2id
+	passwordHasher.Argon2 = Argon2Params{Memory: 64, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+
+	//A wrong password leaves the hash alone
+	w := request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: "not my password"})
+	if w.Code == http.StatusOK {
+		t.Fatal("signed in with the wrong password")
+	}
+	if storedHash(t, user.UserID) != bcryptHash {
+		t.Fatal("a failed signin changed the hash")
+	}
+
+	w = request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("signin: got %d %s", w.Code, w.Body.String())
+	}
+	argon2Hash := storedHash(t, user.UserID)
+	if !strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("got hash %q, want it made with the current Argon2id settings", argon2Hash)
+	}
+
+	//A hash made with the current settings is kept
+	w = request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("signin with the new hash: got %d %s", w.Code, w.Body.String())
+	}
+	if storedHash(t, user.UserID) != argon2Hash {
+		t.Error("an up to date hash was replaced")
+	}
+
+	//Going back to bcrypt with a higher cost upgrades it again
+	passwordHasher = saved
+	passwordHasher.BcryptCost = saved.BcryptCost + 1
+	w = request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("signin back on bcrypt: got %d %s", w.Code, w.Body.String())
+	}
+	cost, err := bcrypt.Cost([]byte(storedHash(t, user.UserID)))
+	if err != nil || cost != passwordHasher.BcryptCost {
+		t.Errorf("got cost %d (%v), want %d", cost, err, passwordHasher.BcryptCost)
+	}
+}
@@ -1,10 +1,11 @@
 package api
 
 import (
+	"crypto/rand"
 	"errors"
-	"math/rand"
 	"time"
 
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
 	"github.com/dgrijalva/jwt-go"
 )
 
@@ -14,18 +15,16 @@ var (
 	//DefaultRefreshJWTExpiry is the default refresh token duration
 	DefaultRefreshJWTExpiry = 30 * 1440 * time.Minute // refresh every 30 days
 	defaultJWTIssuer        = "CalChat"
-	jwtKey                  = []byte("my_secret_key")
 )
 
-//AuthClaims represents the claims in the access token
-type AuthClaims struct {
-	UserID string
-	jwt.StandardClaims
-}
+//AuthClaims represents the claims in the access token, they are shared with the services that verify it
+type AuthClaims = authn.AuthClaims
 
 func setClaims(claims AuthClaims) (tokenString string, Error error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	kid, key := jwtKeys.signingKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
@@ -33,26 +32,55 @@ func setClaims(claims AuthClaims) (tokenString string, Error error) {
 }
 
 func getClaims(tokenString string) (claims AuthClaims, Error error) {
-	claims = AuthClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	parsed, err := authn.ParseToken(tokenString, jwtKeys.publicKey)
 	if err != nil {
 		return AuthClaims{}, err
 	}
-	if !token.Valid {
-		return AuthClaims{}, errors.New("The given token is not valid")
+	return *parsed, nil
+}
+
+//localVerifier checks access tokens against our own keys and session store, so our
+//routes can be protected with the same middleware as the other services
+type localVerifier struct{}
+
+func (localVerifier) Verify(tokenString string) (*AuthClaims, error) {
+	claims, err := getClaims(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject != "access" {
+		return nil, errors.New("not an access token")
 	}
-	return claims, nil
+	//Only a user logged in to BearChat itself may manage the account
+	if claims.ClientID != "" {
+		return nil, errors.New("token was issued to an OAuth client")
+	}
+	revoked, err := sessionStore.IsRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+	return &claims, nil
 }
 
-//GetRandomBase62 returns a string of random base62 characters
+//GetRandomBase62 returns a string of random base62 characters drawn from crypto/rand
 func GetRandomBase62(length int) string {
 	const base62 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	rand.Seed(time.Now().Unix())
-	r := make([]byte, length)
-	for i := range r {
-		r[i] = base62[rand.Intn(len(base62))]
+	r := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(r) < length {
+		_, err := rand.Read(buf)
+		if err != nil {
+			panic("crypto/rand failed: " + err.Error())
+		}
+		for _, b := range buf {
+			// 248 is the largest multiple of 62 that fits in a byte, skipping the rest avoids modulo bias
+			if b < 248 && len(r) < length {
+				r = append(r, base62[b%62])
+			}
+		}
 	}
 	return string(r)
-}
\ No newline at end of file
+}
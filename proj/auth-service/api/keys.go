@@ -0,0 +1,156 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//jwtKeys holds every key that tokens may be signed with, see InitKeys
+var jwtKeys *keyRing
+
+//keyRing is the set of active signing keys, indexed by key id. Only one key signs new
+//tokens but all of them verify, so a key can be rotated out without logging anyone out.
+type keyRing struct {
+	signingKeyID string
+	keys         map[string]*rsa.PrivateKey
+}
+
+//jsonWebKey is the public half of a signing key as published in the JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+//InitKeys loads the RSA private keys from JWT_KEYS_DIR, one PEM file per key named <kid>.pem.
+//JWT_SIGNING_KEY_ID picks the key that signs new tokens and defaults to the last kid in
+//sorted order. To rotate, add the new key, switch the signing key and remove the old file
+//once the tokens it signed have expired. Without a key directory an ephemeral key is
+//generated, which is only suitable for local development.
+func InitKeys() error {
+	ring := &keyRing{keys: make(map[string]*rsa.PrivateKey)}
+
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		log.Println("JWT_KEYS_DIR is not set, generating an ephemeral signing key")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		ring.signingKeyID = "dev-" + GetRandomBase62(8)
+		ring.keys[ring.signingKeyID] = key
+		jwtKeys = ring
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no signing keys found in %s", dir)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		key, err := loadPrivateKey(path)
+		if err != nil {
+			return fmt.Errorf("loading %s: %v", path, err)
+		}
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		ring.keys[kid] = key
+		ring.signingKeyID = kid
+	}
+
+	if kid := os.Getenv("JWT_SIGNING_KEY_ID"); kid != "" {
+		if _, ok := ring.keys[kid]; !ok {
+			return fmt.Errorf("signing key %s not found in %s", kid, dir)
+		}
+		ring.signingKeyID = kid
+	}
+	jwtKeys = ring
+	return nil
+}
+
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("only RSA keys are supported")
+	}
+	return key, nil
+}
+
+//signingKey returns the key id and key that sign new tokens
+func (k *keyRing) signingKey() (string, *rsa.PrivateKey) {
+	return k.signingKeyID, k.keys[k.signingKeyID]
+}
+
+//publicKey returns the verification key for the given key id
+func (k *keyRing) publicKey(kid string) (*rsa.PublicKey, error) {
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return &key.PublicKey, nil
+}
+
+//jwks returns the public keys in JSON Web Key Set form
+func (k *keyRing) jwks() []jsonWebKey {
+	kids := make([]string, 0, len(k.keys))
+	for kid := range k.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	keys := make([]jsonWebKey, 0, len(kids))
+	for _, kid := range kids {
+		pub := k.keys[kid].PublicKey
+		keys = append(keys, jsonWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return keys
+}
+
+//getJWKS publishes the public keys so the other services can verify tokens without being able to mint them
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": jwtKeys.jwks()})
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const purposeMagicLink = "magic_link"
+
+//magicLinkTTL is how long a sign-in link stays valid
+var magicLinkTTL = 15 * time.Minute
+
+//sendMagicLink emails a one-time sign-in link to the address, if it has an account
+func sendMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	credentials := Credentials{}
+	err := json.NewDecoder(r.Body).Decode(&credentials)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding credentials from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	if !strings.Contains(credentials.Email, "@") {
+		http.Error(w, "400", http.StatusBadRequest)
+		return
+	}
+
+	//Links are throttled like reset emails, every request counts
+	limits := []limitKey{
+		{ipLimiter, "magiclink:ip:" + clientIP(r)},
+		{resetLimiter, "magiclink:email:" + credentials.Email},
+	}
+	if !checkLimits(w, limits...) {
+		return
+	}
+	recordAttempts(limits...)
+
+	//Don't let on whether the email has an account
+	var userID string
+	err = DB.QueryRow("SELECT userId FROM users WHERE email = ?", credentials.Email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error retrieving user with this email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	token, err := tokenService.Issue(purposeMagicLink, userID, magicLinkTTL)
+	if err != nil {
+		http.Error(w, errors.New("error creating sign in link").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	err = SendEmail(credentials.Email, "Your BearChat sign in link", "magic-link.html", map[string]interface{}{"Token": token, "Minutes": int(magicLinkTTL.Minutes())})
+	if err != nil {
+		http.Error(w, errors.New("error sending sign in email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+}
+
+//consumeMagicLink redeems a sign-in link and logs the user in like signin does
+func consumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, errors.New("Url Param 'token' is missing").Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := tokenService.Consume(purposeMagicLink, token)
+	if err == errTokenInvalid {
+		recordEvent(r, eventSignin, "", outcomeFailure)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming sign in link").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	//Following the link proves the user owns the address
+	_, err = DB.Exec("UPDATE users SET verified = TRUE WHERE userId = ?", userID)
+	if err != nil {
+		http.Error(w, errors.New("error verifying user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	//The link replaces the password, a second factor is still asked for
+	pending, err := finishSignin(w, r, userID)
+	if err == errAccountLocked {
+		recordEvent(r, eventSignin, userID, outcomeBlocked)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if pending {
+		recordEvent(r, eventSignin, userID, outcomeMFARequired)
+		return
+	}
+	recordEvent(r, eventSignin, userID, outcomeSuccess)
+}
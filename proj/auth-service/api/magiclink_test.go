@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+//sendTestMagicLink asks for a sign in link for the user and returns its token
+func sendTestMagicLink(t *testing.T, user testUser) string {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/magiclink", Credentials{Email: user.Email})
+	if w.Code != http.StatusOK {
+		t.Fatalf("magic link: got %d %s", w.Code, w.Body.String())
+	}
+	return emailedToken(t, user, "magic-link.html")
+}
+
+func TestMagicLinkSignsIn(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "magic")
+	token := sendTestMagicLink(t, user)
+
+	w := request(t, http.MethodPost, "/api/auth/magiclink/consume?token="+token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("consume: got %d %s", w.Code, w.Body.String())
+	}
+	if got := loggedInAs(t, w); got != user.UserID {
+		t.Errorf("logged in as %s, want %s", got, user.UserID)
+	}
+
+	//Following the link proves the address, and it only works once
+	var verified bool
+	err := DB.QueryRow("SELECT verified FROM users WHERE userId = ?", user.UserID).Scan(&verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Error("the account is not verified")
+	}
+	if w := request(t, http.MethodPost, "/api/auth/magiclink/consume?token="+token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("second use: got %d, want 400", w.Code)
+	}
+}
+
+func TestMagicLinkExpires(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "magicold")
+	token := sendTestMagicLink(t, user)
+	_, err := DB.Exec("UPDATE auth_tokens SET expiresAt = ? WHERE tokenHash = ?", time.Now().Add(-time.Minute), hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := request(t, http.MethodPost, "/api/auth/magiclink/consume?token="+token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expired link: got %d, want 400", w.Code)
+	}
+}
+
+func TestMagicLinkUnknownEmailSendsNothing(t *testing.T) {
+	resetLimits()
+	recipient := "nobody-" + GetRandomBase62(8) + "@example.com"
+	w := request(t, http.MethodPost, "/api/auth/magiclink", Credentials{Email: recipient})
+	if w.Code != http.StatusOK {
+		t.Fatalf("magic link: got %d %s", w.Code, w.Body.String())
+	}
+	if email, ok := testMailer.Last(recipient); ok {
+		t.Errorf("got %q, want no email", email.Subject)
+	}
+}
+
+func TestMagicLinkIsThrottled(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "magicspam")
+	for i := 0; i < resetLimiter.Limit; i++ {
+		sendTestMagicLink(t, user)
+	}
+	w := request(t, http.MethodPost, "/api/auth/magiclink", Credentials{Email: user.Email})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q, want 429", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestMagicLinkStillAsksForTOTP(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "magicmfa")
+	enrollTestTOTP(t, user)
+	token := sendTestMagicLink(t, user)
+
+	//The link replaces the password, not the second factor
+	w := request(t, http.MethodPost, "/api/auth/magiclink/consume?token="+token, nil)
+	if w.Code != http.StatusAccepted || len(w.Result().Cookies()) != 0 {
+		t.Errorf("got %d with %d cookies, want 202 and only an mfa token", w.Code, len(w.Result().Cookies()))
+	}
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//mailer is the backend SendEmail hands messages to, see InitMailer
+var mailer Mailer
+
+//Email is a rendered message. Template and Data are kept alongside the HTML so that
+//tests can look at what went into a message (e.g. the token) without parsing it.
+type Email struct {
+	Recipient string
+	Subject   string
+	Template  string
+	Data      map[string]interface{}
+	HTML      string
+}
+
+//Mailer delivers emails
+type Mailer interface {
+	Send(email Email) error
+}
+
+//InitMailer initializes the mail backend chosen by MAIL_BACKEND:
+//  sendgrid (default) uses SENDGRID_KEY
+//  smtp uses SMTP_HOST, SMTP_PORT, SMTP_USERNAME and SMTP_PASSWORD
+//  file writes every message into the MAILDIR directory for local development
+//  memory keeps the messages in memory, for tests
+func InitMailer() error {
+	// load environmental variables
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "", "sendgrid":
+		mailer = NewSendGridMailer(os.Getenv("SENDGRID_KEY"))
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = NewSMTPMailer(os.Getenv("SMTP_HOST"), port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), defaultSender.Address)
+	case "file":
+		dir := os.Getenv("MAILDIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		fileMailer, err := NewFileMailer(dir)
+		if err != nil {
+			return err
+		}
+		mailer = fileMailer
+	case "memory":
+		mailer = NewMemoryMailer()
+	default:
+		return fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+	return nil
+}
+
+//SendEmail sends an email to the recipient with the specified subject
+func SendEmail(recipient string, subject string, templatePath string, data map[string]interface{}) error {
+	// Parse template file and execute with data.
+	var html bytes.Buffer
+	tmpl, err := template.ParseFiles("./api/templates/" + templatePath)
+	if err != nil {
+		return err
+	}
+	err = tmpl.Execute(&html, data)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(Email{
+		Recipient: recipient,
+		Subject:   subject,
+		Template:  templatePath,
+		Data:      data,
+		HTML:      html.String(),
+	})
+}
+
+//errRecipientInvalid is returned for a recipient that would break out of the To: header
+var errRecipientInvalid = errors.New("recipient can't contain line breaks")
+
+//mimeMessage renders the email as an RFC 5322 message
+func (e Email) mimeMessage(from string) ([]byte, error) {
+	if strings.ContainsAny(e.Recipient, "\r\n") {
+		return nil, errRecipientInvalid
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", e.Recipient)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(e.HTML)
+	return msg.Bytes(), nil
+}
+
+//SMTPMailer delivers email to an SMTP relay
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+//NewSMTPMailer returns an SMTPMailer for the relay at host:port. Authentication is
+//skipped when no username is given.
+func NewSMTPMailer(host string, port string, username string, password string, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{addr: host + ":" + port, auth: auth, from: from}
+}
+
+func (m *SMTPMailer) Send(email Email) error {
+	msg, err := email.mimeMessage(m.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{email.Recipient}, msg)
+}
+
+//FileMailer drops every message into a maildir instead of sending it
+type FileMailer struct {
+	dir string
+}
+
+//NewFileMailer returns a FileMailer writing into dir, creating the maildir layout if needed
+func NewFileMailer(dir string) (*FileMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(email Email) error {
+	msg, err := email.mimeMessage(defaultSender.Address)
+	if err != nil {
+		return err
+	}
+
+	// Write to tmp and move into new so readers never see half a message
+	name := fmt.Sprintf("%d.%s.bearchat", time.Now().UnixNano(), GetRandomBase62(8))
+	tmp := filepath.Join(m.dir, "tmp", name)
+	err = ioutil.WriteFile(tmp, msg, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, "new", name))
+}
+
+//MemoryMailer keeps every message in memory so tests can assert on them
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Email
+}
+
+//NewMemoryMailer returns an empty MemoryMailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+//Sent returns every message sent so far, oldest first
+func (m *MemoryMailer) Sent() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Email(nil), m.sent...)
+}
+
+//Last returns the most recent message sent to the recipient
+func (m *MemoryMailer) Last(recipient string) (Email, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].Recipient == recipient {
+			return m.sent[i], true
+		}
+	}
+	return Email{}, false
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignupSendsVerificationEmail(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "mailer")
+
+	email, ok := testMailer.Last(user.Email)
+	if !ok {
+		t.Fatal("no email was sent to " + user.Email)
+	}
+	if email.Subject != "Email Verification" || email.Template != "user-signup.html" {
+		t.Errorf("got %q from %s, want the verification email", email.Subject, email.Template)
+	}
+	token, _ := email.Data["Token"].(string)
+	if len(token) != tokenSize {
+		t.Fatalf("got token %q, want %d characters", token, tokenSize)
+	}
+	if !strings.Contains(email.HTML, token) {
+		t.Error("the token is not in the rendered email")
+	}
+
+	//The emailed token is the one that verifies the account
+	w := request(t, http.MethodPost, "/api/auth/verify?token="+token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: got %d %s", w.Code, w.Body.String())
+	}
+	var verified bool
+	err := DB.QueryRow("SELECT verified FROM users WHERE userId = ?", user.UserID).Scan(&verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Error("the account is not verified")
+	}
+}
+
+func TestSendResetEmailsToken(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "reset")
+
+	w := request(t, http.MethodPost, "/api/auth/sendreset", Credentials{Username: user.Username, Email: user.Email, Password: "unused"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("sendreset: got %d %s", w.Code, w.Body.String())
+	}
+	email, ok := testMailer.Last(user.Email)
+	if !ok || email.Template != "password-reset.html" {
+		t.Fatalf("got %+v, want the password reset email", email)
+	}
+	if email.Subject != "BearChat Password Reset" {
+		t.Errorf("got subject %q", email.Subject)
+	}
+	token, _ := email.Data["Token"].(string)
+	if !strings.Contains(email.HTML, "reset?token="+token) {
+		t.Error("the reset link is not in the rendered email")
+	}
+
+	newPassword := "a brand new passphrase"
+	w = request(t, http.MethodPost, "/api/auth/resetpw?token="+token, Credentials{Username: user.Username, Email: user.Email, Password: newPassword})
+	if w.Code != http.StatusOK {
+		t.Fatalf("resetpw: got %d %s", w.Code, w.Body.String())
+	}
+	w = request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: newPassword})
+	if w.Code != http.StatusOK {
+		t.Errorf("signin with the new password: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendResetUnknownEmailSendsNothing(t *testing.T) {
+	resetLimits()
+	recipient := "nobody-" + GetRandomBase62(8) + "@example.com"
+
+	//The answer is the same as for a known email, so accounts can't be discovered
+	w := request(t, http.MethodPost, "/api/auth/sendreset", Credentials{Username: "nobody", Email: recipient, Password: "unused"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("sendreset: got %d %s", w.Code, w.Body.String())
+	}
+	if email, ok := testMailer.Last(recipient); ok {
+		t.Errorf("got %q, want no email", email.Subject)
+	}
+}
+
+func TestFileMailerWritesMaildir(t *testing.T) {
+	dir := t.TempDir()
+	fileMailer, err := NewFileMailer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fileMailer.Send(Email{Recipient: "someone@example.com", Subject: "Hello", HTML: "<p>hi</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 {
+		t.Fatalf("got %d messages in new, want 1", len(delivered))
+	}
+	leftover, _ := filepath.Glob(filepath.Join(dir, "tmp", "*"))
+	if len(leftover) != 0 {
+		t.Errorf("got %d messages left in tmp", len(leftover))
+	}
+
+	message, err := ioutil.ReadFile(delivered[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: someone@example.com\r\n", "Subject: Hello\r\n", "Content-Type: text/html; charset=UTF-8\r\n", "\r\n\r\n<p>hi</p>"} {
+		if !strings.Contains(string(message), want) {
+			t.Errorf("message is missing %q:\n%s", want, message)
+		}
+	}
+}
+
+func TestFileMailerRejectsHeaderInjection(t *testing.T) {
+	dir := t.TempDir()
+	fileMailer, err := NewFileMailer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipient := range []string{"someone@example.com\r\nBcc: everyone@example.com", "someone@example.com\nBcc: everyone@example.com"} {
+		err = fileMailer.Send(Email{Recipient: recipient, Subject: "Hello", HTML: "<p>hi</p>"})
+		if err != errRecipientInvalid {
+			t.Errorf("sending to %q: got %v, want errRecipientInvalid", recipient, err)
+		}
+	}
+	delivered, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(delivered) != 0 {
+		t.Errorf("got %d messages written, want none", len(delivered))
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/testdb"
+	"github.com/gorilla/mux"
+)
+
+//testRouter has every route of the service, set up the way main.go does it
+var testRouter *mux.Router
+
+//testMailer catches the emails the handlers send
+var testMailer *MemoryMailer
+
+//TestMain runs the tests against an in-process MySQL server loaded with the schema of
+//db-server, so the handlers run the same queries they do in production
+func TestMain(m *testing.M) {
+	addr, err := testdb.Start("../../db-server/initdb.sql")
+	if err != nil {
+		log.Fatal(err)
+	}
+	DB, err = sql.Open("mysql", "root@tcp("+addr+")/auth?parseTime=true")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Templates are read relative to the service directory, like when main.go runs
+	err = os.Chdir("..")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("RATE_LIMIT_STORE", "memory")
+	os.Setenv("JWT_KEYS_DIR", "")
+	os.Setenv("BCRYPT_COST", "4")
+	err = InitKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	testMailer = NewMemoryMailer()
+	mailer = testMailer
+
+	testRouter = mux.NewRouter()
+	err = RegisterRoutes(testRouter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+//resetLimits forgets every attempt counted by the rate limiters, so one test can't lock
+//out the next one from the shared test address
+func resetLimits() {
+	InitRateLimiters(NewMemoryAttemptStore())
+}
+
+//request runs a request through testRouter with the cookies, body is encoded as JSON
+func request(t *testing.T, method string, target string, body interface{}, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	r.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	return w
+}
+
+//decode reads the JSON body of a response into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	err := json.NewDecoder(strings.NewReader(w.Body.String())).Decode(v)
+	if err != nil {
+		t.Fatalf("decoding %q: %s", w.Body.String(), err)
+	}
+}
+
+//testUser is an account created through signup
+type testUser struct {
+	Username string
+	Email    string
+	Password string
+	UserID   string
+	Cookies  []*http.Cookie
+}
+
+//signupUser creates a new account with a unique username and email and keeps its cookies
+func signupUser(t *testing.T, name string) testUser {
+	t.Helper()
+	suffix := GetRandomBase62(8)
+	user := testUser{
+		Username: name + suffix,
+		Email:    name + suffix + "@example.com",
+		Password: "correct horse battery staple",
+	}
+	w := request(t, http.MethodPost, "/api/auth/signup", Credentials{Username: user.Username, Email: user.Email, Password: user.Password})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signup: got %d %s", w.Code, w.Body.String())
+	}
+	user.Cookies = w.Result().Cookies()
+	err := DB.QueryRow("SELECT userId FROM users WHERE username = ?", user.Username).Scan(&user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,689 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	purposeOAuthCode    = "oauth_code"
+	purposeOAuthConsent = "oauth_consent"
+
+	//oauthSecretPrefix starts the secrets of confidential clients
+	oauthSecretPrefix = "bcs_"
+)
+
+var (
+	//oauthCodeTTL is how long an authorization code can be exchanged for tokens
+	oauthCodeTTL = 5 * time.Minute
+	//oauthConsentTTL is how long the consent screen can be answered
+	oauthConsentTTL = 10 * time.Minute
+
+	errConsentInvalid = errors.New("this consent request is invalid or expired, load it again")
+)
+
+//OAuthClient is a third-party app registered by a BearChat user
+type OAuthClient struct {
+	ID           string    `json:"clientId"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"createdAt"`
+	//Secret is only set in the response to the registration, only its hash is stored
+	Secret string `json:"clientSecret,omitempty"`
+
+	secretHash string
+}
+
+//OAuthGrant is the consent a user gave a client
+type OAuthGrant struct {
+	ClientID   string    `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+//authorizationRequest is a validated request to /oauth/authorize
+type authorizationRequest struct {
+	Client        *OAuthClient `json:"-"`
+	ClientID      string       `json:"clientId"`
+	ClientName    string       `json:"clientName"`
+	RedirectURI   string       `json:"redirectUri"`
+	Scopes        []string     `json:"scopes"`
+	State         string       `json:"state,omitempty"`
+	CodeChallenge string       `json:"codeChallenge"`
+	//ConsentToken has to be posted back with the decision, see authorize
+	ConsentToken string `json:"consentToken,omitempty"`
+}
+
+//authorizationCode is what an authorization code stands for, stored as the data of its token
+type authorizationCode struct {
+	ClientID      string   `json:"clientId"`
+	RedirectURI   string   `json:"redirectUri"`
+	Scopes        []string `json:"scopes"`
+	CodeChallenge string   `json:"codeChallenge"`
+}
+
+//tokenResponse is the body of a successful /oauth/token request
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+//oauthError writes an error in the format of RFC 6749 section 5.2
+func oauthError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+//loadOAuthClient returns the client with the id, or nil if there is none
+func loadOAuthClient(clientID string) (*OAuthClient, error) {
+	client := OAuthClient{ID: clientID}
+	var redirectURIs, scopes string
+	err := DB.QueryRow("SELECT name, redirectUris, scopes, secretHash, createdAt FROM oauth_clients WHERE clientId = ?", clientID).
+		Scan(&client.Name, &redirectURIs, &scopes, &client.secretHash, &client.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	client.Confidential = client.secretHash != ""
+	return &client, nil
+}
+
+//validRedirectURI only accepts absolute URIs without a fragment, over https unless they
+//point back to the user's own machine
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	host := u.Hostname()
+	return u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1")
+}
+
+//containsAll reports whether every one of want is in have
+func containsAll(have []string, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//registerOAuthClient registers a client owned by the logged in user. Confidential
+//clients get a secret, public ones (apps that can't keep one) rely on PKCE alone.
+func registerOAuthClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	var request struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirectUris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding client from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if len(request.Name) < 1 || len(request.Name) > 64 || len(request.RedirectURIs) < 1 || len(request.Scopes) < 1 {
+		http.Error(w, "400", http.StatusBadRequest)
+		return
+	}
+	for _, uri := range request.RedirectURIs {
+		if !validRedirectURI(uri) || strings.ContainsAny(uri, " \t\n") {
+			http.Error(w, errors.New("invalid redirect URI "+uri).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, scope := range request.Scopes {
+		if !authn.ValidScope(scope) {
+			http.Error(w, errors.New("unknown scope "+scope).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	client := OAuthClient{
+		ID:           uuid.New().String(),
+		Name:         request.Name,
+		RedirectURIs: request.RedirectURIs,
+		Scopes:       request.Scopes,
+		Confidential: request.Confidential,
+		CreatedAt:    time.Now(),
+	}
+	if client.Confidential {
+		client.Secret = oauthSecretPrefix + GetRandomBase62(apiKeySize)
+		client.secretHash = hashToken(client.Secret)
+	}
+	_, err = DB.Exec("INSERT INTO oauth_clients (clientId, userId, name, redirectUris, scopes, secretHash, createdAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		client.ID, claims.UserID, client.Name, strings.Join(client.RedirectURIs, " "), strings.Join(client.Scopes, " "), client.secretHash, client.CreatedAt)
+	if err != nil {
+		http.Error(w, errors.New("error registering client").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(client)
+}
+
+//listOAuthClients returns the clients the logged in user registered
+func listOAuthClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	rows, err := DB.Query("SELECT clientId, name, redirectUris, scopes, secretHash, createdAt FROM oauth_clients WHERE userId = ? ORDER BY createdAt", claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving clients").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		var client OAuthClient
+		var redirectURIs, scopes string
+		err = rows.Scan(&client.ID, &client.Name, &redirectURIs, &scopes, &client.secretHash, &client.CreatedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving clients").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		client.RedirectURIs = strings.Fields(redirectURIs)
+		client.Scopes = strings.Fields(scopes)
+		client.Confidential = client.secretHash != ""
+		clients = append(clients, client)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clients)
+}
+
+//deleteOAuthClient removes a client of the logged in user and ends every session it has
+func deleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	clientID := mux.Vars(r)["clientId"]
+
+	res, err := DB.Exec("DELETE FROM oauth_clients WHERE clientId = ? AND userId = ?", clientID, claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error deleting client").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, errors.New("error deleting client").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if n == 0 {
+		http.Error(w, errors.New("this client does not exist").Error(), http.StatusNotFound)
+		return
+	}
+
+	//The client is gone for every user that granted it access
+	_, err = DB.Exec("DELETE FROM oauth_grants WHERE clientId = ?", clientID)
+	if err == nil {
+		_, err = DB.Exec("UPDATE sessions SET revokedAt = ? WHERE clientId = ? AND revokedAt IS NULL", time.Now(), clientID)
+	}
+	if err != nil {
+		http.Error(w, errors.New("error revoking client sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//listOAuthGrants returns the clients the logged in user gave access to
+func listOAuthGrants(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	rows, err := DB.Query("SELECT g.clientId, c.name, g.scopes, g.createdAt FROM oauth_grants g JOIN oauth_clients c ON c.clientId = g.clientId WHERE g.userId = ? ORDER BY g.createdAt", claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving grants").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	grants := []OAuthGrant{}
+	for rows.Next() {
+		var grant OAuthGrant
+		var scopes string
+		err = rows.Scan(&grant.ClientID, &grant.ClientName, &scopes, &grant.CreatedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving grants").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		grant.Scopes = strings.Fields(scopes)
+		grants = append(grants, grant)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+//revokeOAuthGrant takes back the access the logged in user gave a client
+func revokeOAuthGrant(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	clientID := mux.Vars(r)["clientId"]
+
+	_, err := DB.Exec("DELETE FROM oauth_grants WHERE userId = ? AND clientId = ?", claims.UserID, clientID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking grant").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	err = sessionStore.RevokeClientSessions(claims.UserID, clientID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking client sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//parseAuthorizationRequest validates the parameters of /oauth/authorize. Until the client
+//and redirect URI check out, errors are shown to the user instead of being redirected,
+//so a forged request can't bounce the user to an arbitrary site.
+func parseAuthorizationRequest(w http.ResponseWriter, r *http.Request) (*authorizationRequest, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "malformed request")
+		return nil, false
+	}
+
+	client, err := loadOAuthClient(r.Form.Get("client_id"))
+	if err != nil {
+		http.Error(w, errors.New("error retrieving client").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return nil, false
+	}
+	if client == nil {
+		oauthError(w, http.StatusBadRequest, "invalid_client", "unknown client_id")
+		return nil, false
+	}
+
+	redirectURI := r.Form.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !containsAll(client.RedirectURIs, []string{redirectURI}) {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for this client")
+		return nil, false
+	}
+
+	request := &authorizationRequest{
+		Client:        client,
+		ClientID:      client.ID,
+		ClientName:    client.Name,
+		RedirectURI:   redirectURI,
+		Scopes:        strings.Fields(r.Form.Get("scope")),
+		State:         r.Form.Get("state"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+	}
+	if r.Form.Get("response_type") != "code" {
+		redirectWithError(w, r, request, "unsupported_response_type", "only the code flow is supported")
+		return nil, false
+	}
+	//PKCE is required from every client, with S256 only
+	if len(request.CodeChallenge) != 43 || r.Form.Get("code_challenge_method") != "S256" {
+		redirectWithError(w, r, request, "invalid_request", "a S256 code_challenge is required")
+		return nil, false
+	}
+	if len(request.Scopes) == 0 {
+		request.Scopes = client.Scopes
+	}
+	if !containsAll(client.Scopes, request.Scopes) {
+		redirectWithError(w, r, request, "invalid_scope", "the client may not ask for these scopes")
+		return nil, false
+	}
+	return request, true
+}
+
+//redirectTo sends the user back to the client with the given parameters added
+func redirectTo(w http.ResponseWriter, r *http.Request, request *authorizationRequest, params url.Values) {
+	u, _ := url.Parse(request.RedirectURI)
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func redirectWithError(w http.ResponseWriter, r *http.Request, request *authorizationRequest, code string, description string) {
+	redirectTo(w, r, request, url.Values{"error": {code}, "error_description": {description}})
+}
+
+//code returns what an authorization code issued for the request stands for
+func (request *authorizationRequest) code() (string, error) {
+	data, err := json.Marshal(authorizationCode{
+		ClientID:      request.ClientID,
+		RedirectURI:   request.RedirectURI,
+		Scopes:        request.Scopes,
+		CodeChallenge: request.CodeChallenge,
+	})
+	return string(data), err
+}
+
+//redirectWithCode issues an authorization code and sends the user back to the client with it
+func redirectWithCode(w http.ResponseWriter, r *http.Request, request *authorizationRequest, userID string) {
+	data, err := request.code()
+	if err != nil {
+		http.Error(w, errors.New("error creating authorization code").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	code, err := tokenService.IssueWithData(purposeOAuthCode, userID, data, oauthCodeTTL)
+	if err != nil {
+		http.Error(w, errors.New("error creating authorization code").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	redirectTo(w, r, request, url.Values{"code": {code}})
+}
+
+//authorize is the consent step of the code flow. GET redirects straight back to the
+//client if the user already granted the scopes, otherwise it returns the request for the
+//frontend to show. POSTing the same parameters with decision=approve or deny answers it.
+//The POST is authenticated by cookie, so it also has to carry the single-use consent
+//token the GET returned for this very request. Another site can make the browser post
+//the form, but it can't read the token.
+func authorize(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	request, ok := parseAuthorizationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var granted string
+		err := DB.QueryRow("SELECT scopes FROM oauth_grants WHERE userId = ? AND clientId = ?", claims.UserID, request.ClientID).Scan(&granted)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, errors.New("error retrieving grant").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if err == nil && containsAll(strings.Fields(granted), request.Scopes) {
+			redirectWithCode(w, r, request, claims.UserID)
+			return
+		}
+		data, err := request.code()
+		if err == nil {
+			request.ConsentToken, err = tokenService.IssueWithData(purposeOAuthConsent, claims.UserID, data, oauthConsentTTL)
+		}
+		if err != nil {
+			http.Error(w, errors.New("error creating consent request").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(request)
+		return
+	}
+
+	data, err := request.code()
+	if err != nil {
+		http.Error(w, errors.New("error checking consent request").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	userID, consented, err := tokenService.ConsumeWithData(purposeOAuthConsent, r.PostForm.Get("consent_token"))
+	if err != nil && err != errTokenInvalid {
+		http.Error(w, errors.New("error checking consent request").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if err == errTokenInvalid || userID != claims.UserID || consented != data {
+		http.Error(w, errConsentInvalid.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.Form.Get("decision") != "approve" {
+		redirectWithError(w, r, request, "access_denied", "the user denied the request")
+		return
+	}
+	_, err = DB.Exec("REPLACE INTO oauth_grants (userId, clientId, scopes, createdAt) VALUES (?, ?, ?, ?)", claims.UserID, request.ClientID, strings.Join(request.Scopes, " "), time.Now())
+	if err != nil {
+		http.Error(w, errors.New("error storing grant").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	redirectWithCode(w, r, request, claims.UserID)
+}
+
+//authenticateClient checks the client credentials of a token request, sent either with
+//HTTP Basic or in the form. Public clients only send their id.
+func authenticateClient(w http.ResponseWriter, r *http.Request) (*OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := loadOAuthClient(clientID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving client").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return nil, false
+	}
+	if client == nil || (client.Confidential && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.secretHash)) != 1) {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+//pkceChallenge returns the S256 code challenge of a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//token exchanges an authorization code or a refresh token for a new token pair
+func token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "malformed request")
+		return
+	}
+	client, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	var userID, sessionID string
+	var scopes []string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		var data string
+		userID, data, err = tokenService.ConsumeWithData(purposeOAuthCode, r.PostForm.Get("code"))
+		if err == errTokenInvalid {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the code is invalid, expired or was already used")
+			return
+		}
+		if err != nil {
+			http.Error(w, errors.New("error redeeming authorization code").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		var code authorizationCode
+		err = json.Unmarshal([]byte(data), &code)
+		if err != nil {
+			http.Error(w, errors.New("error redeeming authorization code").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the code was issued to another client or redirect_uri")
+			return
+		}
+		verifier := r.PostForm.Get("code_verifier")
+		if len(verifier) < 43 || len(verifier) > 128 || subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(code.CodeChallenge)) != 1 {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+			return
+		}
+		scopes = code.Scopes
+
+	case "refresh_token":
+		claims, err := getClaims(r.PostForm.Get("refresh_token"))
+		if err != nil || claims.Subject != "refresh" || claims.ClientID != client.ID {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is not valid for this client")
+			return
+		}
+		revoked, err := sessionStore.IsRevoked(claims)
+		if err != nil {
+			http.Error(w, errors.New("error checking token revocation").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if revoked {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "the grant has been revoked")
+			return
+		}
+		//A refresh may narrow the scopes but never widen them
+		scopes = claims.Scopes
+		if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+			if !containsAll(claims.Scopes, requested) {
+				oauthError(w, http.StatusBadRequest, "invalid_scope", "the refresh token doesn't cover these scopes")
+				return
+			}
+			scopes = requested
+		}
+		sessionID, err = consumeRefreshToken(claims.Id)
+		if err == errRefreshTokenInvalid || err == errRefreshTokenReused {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		if err != nil {
+			http.Error(w, errors.New("error consuming refresh token").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		userID = claims.UserID
+
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code and refresh_token are supported")
+		return
+	}
+
+	tokens, err := mintTokens(r, userID, sessionID, client.ID, scopes)
+	if err == errAccountLocked {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(tokens.AccessExpiresAt).Seconds()),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+)
+
+const testRedirectURI = "http://127.0.0.1:8085/callback"
+
+//postForm posts a form-encoded body through testRouter, like the consent screen and
+//clients do
+func postForm(t *testing.T, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	return w
+}
+
+//registerTestClient registers a confidential client owned by the user
+func registerTestClient(t *testing.T, user testUser, scopes ...string) OAuthClient {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/oauth/clients", map[string]interface{}{
+		"name":         "Test app",
+		"redirectUris": []string{testRedirectURI},
+		"scopes":       scopes,
+		"confidential": true,
+	}, user.Cookies...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register client: got %d %s", w.Code, w.Body.String())
+	}
+	var client OAuthClient
+	err := json.NewDecoder(w.Body).Decode(&client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Secret == "" {
+		t.Fatal("a confidential client got no secret")
+	}
+	return client
+}
+
+//codeFromRedirect checks that the response sends the user back to the client with the
+//state and returns the code
+func codeFromRedirect(t *testing.T, w *httptest.ResponseRecorder, state string) string {
+	t.Helper()
+	if w.Code != http.StatusFound {
+		t.Fatalf("got %d %s, want a redirect back to the client", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectURI+"?") {
+		t.Fatalf("redirected to %s", location)
+	}
+	query := location.Query()
+	if query.Get("state") != state {
+		t.Errorf("got state %q, want %q", query.Get("state"), state)
+	}
+	if e := query.Get("error"); e != "" {
+		t.Fatalf("authorization failed: %s: %s", e, query.Get("error_description"))
+	}
+	return query.Get("code")
+}
+
+//consentRequest asks for the consent screen of the authorization request and returns it
+func consentRequest(t *testing.T, params url.Values, user testUser) authorizationRequest {
+	t.Helper()
+	w := request(t, http.MethodGet, "/oauth/authorize?"+params.Encode(), nil, user.Cookies...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("authorize: got %d %s", w.Code, w.Body.String())
+	}
+	var consent authorizationRequest
+	err := json.NewDecoder(w.Body).Decode(&consent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consent.ConsentToken == "" {
+		t.Fatal("the consent request has no consent token")
+	}
+	return consent
+}
+
+//approve answers the consent screen of the authorization request like the frontend does
+func approve(t *testing.T, params url.Values, user testUser) *httptest.ResponseRecorder {
+	t.Helper()
+	consent := consentRequest(t, params, user)
+	form := url.Values{"decision": {"approve"}, "consent_token": {consent.ConsentToken}}
+	for k, v := range params {
+		form[k] = v
+	}
+	return postForm(t, "/oauth/authorize", form, user.Cookies...)
+}
+
+//exchange posts a token request with the client's credentials and decodes the answer
+func exchange(t *testing.T, client OAuthClient, form url.Values) (int, tokenResponse, string) {
+	t.Helper()
+	form.Set("client_id", client.ID)
+	form.Set("client_secret", client.Secret)
+	w := postForm(t, "/oauth/token", form)
+	var tokens tokenResponse
+	var failure struct {
+		Error string `json:"error"`
+	}
+	body := w.Body.Bytes()
+	json.Unmarshal(body, &tokens)
+	json.Unmarshal(body, &failure)
+	return w.Code, tokens, failure.Error
+}
+
+func TestOAuthCodeFlow(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "oauth")
+	client := registerTestClient(t, user, "posts:read")
+
+	verifier := GetRandomBase62(64)
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"posts:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	//Nothing granted yet, so the request comes back for the consent screen
+	consent := consentRequest(t, params, user)
+	if consent.ClientID != client.ID || len(consent.Scopes) != 1 || consent.Scopes[0] != "posts:read" {
+		t.Errorf("got consent request %+v", consent)
+	}
+	code := codeFromRedirect(t, approve(t, params, user), "xyz")
+
+	//A wrong verifier is refused, and the code is used up with it
+	status, _, e := exchange(t, client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {GetRandomBase62(64)},
+	})
+	if status != http.StatusBadRequest || e != "invalid_grant" {
+		t.Fatalf("wrong code_verifier: got %d %q, want invalid_grant", status, e)
+	}
+	status, _, e = exchange(t, client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != http.StatusBadRequest || e != "invalid_grant" {
+		t.Fatalf("reused code: got %d %q, want invalid_grant", status, e)
+	}
+
+	//The scopes are granted now, so authorize sends the user straight back
+	code = codeFromRedirect(t, request(t, http.MethodGet, "/oauth/authorize?"+params.Encode(), nil, user.Cookies...), "xyz")
+	status, tokens, e := exchange(t, client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("code exchange: got %d %q", status, e)
+	}
+	if tokens.TokenType != "Bearer" || tokens.Scope != "posts:read" || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("got %+v", tokens)
+	}
+
+	//Routes of the other services verify the token remotely and check its scopes
+	auth := httptest.NewServer(testRouter)
+	defer auth.Close()
+	scoped := http.NewServeMux()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	scoped.Handle("/read", authn.Middleware(authn.NewRemoteVerifier(auth.URL))(authn.RequireScope("posts:read")(ok)))
+	scoped.Handle("/write", authn.Middleware(authn.NewRemoteVerifier(auth.URL))(authn.RequireScope("posts:write")(ok)))
+	for path, want := range map[string]int{"/read": http.StatusOK, "/write": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		w := httptest.NewRecorder()
+		scoped.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+
+	//auth-service's own routes refuse tokens issued to a client
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/sessions", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /api/auth/sessions with a client token: got %d", w.Code)
+	}
+
+	//Refreshing can't widen the scopes, and the refresh token rotates
+	status, _, e = exchange(t, client, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}, "scope": {"posts:read posts:write"}})
+	if status != http.StatusBadRequest || e != "invalid_scope" {
+		t.Errorf("widening refresh: got %d %q, want invalid_scope", status, e)
+	}
+	status, refreshed, e := exchange(t, client, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if status != http.StatusOK {
+		t.Fatalf("refresh: got %d %q", status, e)
+	}
+	if refreshed.Scope != "posts:read" || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("got %+v", refreshed)
+	}
+	status, _, e = exchange(t, client, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if status != http.StatusBadRequest || e != "invalid_grant" {
+		t.Errorf("reused refresh token: got %d %q, want invalid_grant", status, e)
+	}
+}
+
+func TestOAuthTokenRequiresClientSecret(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "oauthsecret")
+	client := registerTestClient(t, user, "posts:read")
+	client.Secret = "bcs_wrong"
+
+	status, _, e := exchange(t, client, url.Values{"grant_type": {"authorization_code"}, "code": {"anything"}})
+	if status != http.StatusUnauthorized || e != "invalid_client" {
+		t.Errorf("got %d %q, want invalid_client", status, e)
+	}
+}
+
+func TestDeleteAccountRevokesItsClients(t *testing.T) {
+	resetLimits()
+	owner := signupUser(t, "oauthowner")
+	user := signupUser(t, "oauthuser")
+	client := registerTestClient(t, owner, "posts:read")
+
+	verifier := GetRandomBase62(64)
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {testRedirectURI},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	code := codeFromRedirect(t, approve(t, params, user), "")
+	status, tokens, e := exchange(t, client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("code exchange: got %d %q", status, e)
+	}
+
+	w := request(t, http.MethodDelete, "/api/auth/account", map[string]string{"password": owner.Password}, owner.Cookies...)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("delete account: got %d %s", w.Code, w.Body.String())
+	}
+
+	//The other user's grant and session through the owner's client are gone too
+	var grants int
+	err := DB.QueryRow("SELECT COUNT(*) FROM oauth_grants WHERE clientId = ?", client.ID).Scan(&grants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grants != 0 {
+		t.Errorf("got %d grants left for the deleted client", grants)
+	}
+	claims, err := getClaims(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := sessionStore.IsRevoked(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("the session of the deleted client is still active")
+	}
+}
+
+func TestOAuthConsentNeedsConsentToken(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "oauthcsrf")
+	client := registerTestClient(t, user, "posts:read")
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {testRedirectURI},
+		"code_challenge":        {pkceChallenge(GetRandomBase62(64))},
+		"code_challenge_method": {"S256"},
+		"decision":              {"approve"},
+	}
+
+	//Another site can make the browser post the form, but not with a consent token
+	w := postForm(t, "/oauth/authorize", params, user.Cookies...)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("without a consent token: got %d %s, want 403", w.Code, w.Body.String())
+	}
+
+	//The token is only good for the request it was shown for
+	consent := consentRequest(t, params, user)
+	forged := url.Values{"consent_token": {consent.ConsentToken}}
+	for k, v := range params {
+		forged[k] = v
+	}
+	forged.Set("code_challenge", pkceChallenge(GetRandomBase62(64)))
+	w = postForm(t, "/oauth/authorize", forged, user.Cookies...)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("with another request's token: got %d %s, want 403", w.Code, w.Body.String())
+	}
+
+	var grants int
+	err := DB.QueryRow("SELECT COUNT(*) FROM oauth_grants WHERE clientId = ?", client.ID).Scan(&grants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grants != 0 {
+		t.Errorf("got %d grants, want none", grants)
+	}
+}
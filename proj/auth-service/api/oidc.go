@@ -0,0 +1,553 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	purposeOIDCState = "oidc_state"
+
+	//oidcStateCookie ties the callback to the browser that started the login
+	oidcStateCookie = "oidc_state"
+)
+
+var (
+	//oidcStateTTL is how long the user has to log in at the provider
+	oidcStateTTL = 10 * time.Minute
+	//oidcLeeway is the clock skew allowed when checking ID token times
+	oidcLeeway = time.Minute
+
+	//oidcProviders are the configured providers by name, see InitOIDCProviders
+	oidcProviders = map[string]*oidcProvider{}
+	oidcClient    = &http.Client{Timeout: 10 * time.Second}
+
+	errOIDCLogin = errors.New("login with the provider failed")
+	//errUnverifiedAccount is a first login whose email belongs to an unverified local account
+	errUnverifiedAccount = errors.New("an account with this email already exists, log in to it and link the provider from there")
+
+	usernameCleaner = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+//oidcProvider is an external OpenID Connect issuer users can log in with
+type oidcProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+
+	mu     sync.Mutex
+	config *oidcConfiguration
+	keys   *authn.KeySet
+}
+
+//oidcConfiguration is the part of the discovery document we use
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+//oidcState is what the state parameter of a login stands for, stored as the data of its token
+type oidcState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+//audience is the aud claim, which may be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*a = list
+	return err
+}
+
+//idTokenClaims are the ID token claims we check or use
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   bool     `json:"email_verified"`
+}
+
+func (c *idTokenClaims) Valid() error {
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.Add(-oidcLeeway).Unix() > c.ExpiresAt {
+		return errors.New("ID token has expired")
+	}
+	if c.IssuedAt > now.Add(oidcLeeway).Unix() {
+		return errors.New("ID token was issued in the future")
+	}
+	return nil
+}
+
+//InitOIDCProviders reads the providers listed in OIDC_PROVIDERS. Each name needs
+//OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and
+//OIDC_<NAME>_REDIRECT_URI, the frontend page that receives the callback.
+func InitOIDCProviders() error {
+	providers := map[string]*oidcProvider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURI:  os.Getenv(prefix + "REDIRECT_URI"),
+		}
+		if p.Issuer == "" || p.ClientID == "" || p.RedirectURI == "" {
+			return fmt.Errorf("OIDC provider %s needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URI", name, prefix, prefix, prefix)
+		}
+		providers[name] = p
+	}
+	oidcProviders = providers
+	return nil
+}
+
+//discover fetches the provider's discovery document the first time it is needed
+func (p *oidcProvider) discover() (*oidcConfiguration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	resp, err := oidcClient.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery for %s failed with status %d", p.Name, resp.StatusCode)
+	}
+	config := &oidcConfiguration{}
+	err = json.NewDecoder(resp.Body).Decode(config)
+	if err != nil {
+		return nil, err
+	}
+	//The document must be about the issuer we were configured with
+	if strings.TrimSuffix(config.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery for %s returned issuer %q", p.Name, config.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery for %s is missing endpoints", p.Name)
+	}
+	p.config = config
+	p.keys = authn.NewKeySet(config.JWKSURI, oidcClient)
+	return config, nil
+}
+
+//exchangeCode trades the authorization code for the provider's ID token
+func (p *oidcProvider) exchangeCode(code string, verifier string) (string, error) {
+	config, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURI},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	resp, err := oidcClient.PostForm(config.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || result.IDToken == "" {
+		return "", fmt.Errorf("token request to %s failed with status %d: %s", p.Name, resp.StatusCode, result.Error)
+	}
+	return result.IDToken, nil
+}
+
+//verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *oidcProvider) verifyIDToken(raw string, nonce string) (*idTokenClaims, error) {
+	_, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.Key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	if !containsAll(claims.Audience, []string{p.ClientID}) {
+		return nil, errors.New("ID token is not for us")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, errors.New("ID token was issued to another party")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+//listOIDCProviders returns the names of the providers the login page can offer
+func listOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	names := []string{}
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+//oidcLogin sends the browser to the provider to log in
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, errors.New("unknown provider").Error(), http.StatusNotFound)
+		return
+	}
+	config, err := provider.discover()
+	if err != nil {
+		http.Error(w, errors.New("error contacting provider").Error(), http.StatusBadGateway)
+		log.Print(err.Error())
+		return
+	}
+
+	//The state is a single-use token, the nonce ties the ID token to this login and the
+	//verifier does PKCE with providers that support it
+	login := oidcState{
+		Provider: provider.Name,
+		Nonce:    GetRandomBase62(tokenSize),
+		Verifier: GetRandomBase62(64),
+	}
+	data, err := json.Marshal(login)
+	if err != nil {
+		http.Error(w, errors.New("error starting login").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	state, err := tokenService.IssueWithData(purposeOIDCState, "", string(data), oidcStateTTL)
+	if err != nil {
+		http.Error(w, errors.New("error starting login").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Expires:  time.Now().Add(oidcStateTTL),
+		HttpOnly: true,
+		Path:     "/api/auth/oidc",
+	})
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	authURL, err := url.Parse(config.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, errors.New("error contacting provider").Error(), http.StatusBadGateway)
+		log.Print(err.Error())
+		return
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", provider.RedirectURI)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", login.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+//oidcCallback finishes a login once the provider sent the user back to the frontend with
+//a code. The frontend posts the code and state here and gets the same response as signin.
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	provider, claims, ok := redeemOIDCCallback(w, r)
+	if !ok {
+		recordEvent(r, eventSignin, "", outcomeFailure)
+		return
+	}
+
+	userID, err := linkExternalIdentity(provider.Name, claims)
+	if err == errUnverifiedAccount {
+		recordEvent(r, eventSignin, "", outcomeFailure)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error linking account").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	pending, err := finishSignin(w, r, userID)
+	if err == errAccountLocked {
+		recordEvent(r, eventSignin, userID, outcomeBlocked)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if pending {
+		recordEvent(r, eventSignin, userID, outcomeMFARequired)
+		return
+	}
+	recordEvent(r, eventSignin, userID, outcomeSuccess)
+}
+
+//redeemOIDCCallback checks the state of a callback, exchanges its code and verifies the ID
+//token. It answers the request itself when something is wrong.
+func redeemOIDCCallback(w http.ResponseWriter, r *http.Request) (*oidcProvider, *idTokenClaims, bool) {
+	var request struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding callback from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return nil, nil, false
+	}
+
+	limits := []limitKey{{ipLimiter, "oidc:ip:" + clientIP(r)}}
+	if !checkLimits(w, limits...) {
+		return nil, nil, false
+	}
+
+	//Only the browser that started the login may finish it
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || request.State == "" || cookie.Value != request.State {
+		recordAttempts(limits...)
+		http.Error(w, errOIDCLogin.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Expires: time.Now().Add(-time.Hour), Path: "/api/auth/oidc"})
+
+	_, data, err := tokenService.ConsumeWithData(purposeOIDCState, request.State)
+	if err == errTokenInvalid {
+		recordAttempts(limits...)
+		http.Error(w, errOIDCLogin.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming login state").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return nil, nil, false
+	}
+	var login oidcState
+	err = json.Unmarshal([]byte(data), &login)
+	if err != nil {
+		http.Error(w, errors.New("error redeeming login state").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return nil, nil, false
+	}
+	provider, ok := oidcProviders[login.Provider]
+	if !ok || login.Provider != mux.Vars(r)["provider"] {
+		http.Error(w, errOIDCLogin.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	idToken, err := provider.exchangeCode(request.Code, login.Verifier)
+	if err != nil {
+		recordAttempts(limits...)
+		http.Error(w, errOIDCLogin.Error(), http.StatusBadGateway)
+		log.Print(err.Error())
+		return nil, nil, false
+	}
+	claims, err := provider.verifyIDToken(idToken, login.Nonce)
+	if err != nil {
+		recordAttempts(limits...)
+		http.Error(w, errOIDCLogin.Error(), http.StatusUnauthorized)
+		log.Print(err.Error())
+		return nil, nil, false
+	}
+	return provider, claims, true
+}
+
+//linkOIDCProvider adds a provider account to the logged in user. It takes the same code and
+//state as oidcCallback and is how an account whose email isn't verified gets single sign-on.
+func linkOIDCProvider(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	user, _ := authn.FromContext(r.Context())
+	provider, claims, ok := redeemOIDCCallback(w, r)
+	if !ok {
+		return
+	}
+
+	var linkedTo string
+	err := DB.QueryRow("SELECT userId FROM external_identities WHERE provider = ? AND subject = ?", provider.Name, claims.Subject).Scan(&linkedTo)
+	if err == nil {
+		if linkedTo != user.UserID {
+			http.Error(w, errors.New("this provider account is linked to another user").Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, errors.New("error linking account").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	_, err = DB.Exec("INSERT INTO external_identities (provider, subject, userId, email, createdAt) VALUES (?, ?, ?, ?, ?)", provider.Name, claims.Subject, user.UserID, claims.Email, time.Now())
+	if err != nil {
+		http.Error(w, errors.New("error linking account").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//linkExternalIdentity returns the local user of the provider account. An account seen for
+//the first time is linked to the user with the same email if both sides verified it, or
+//gets a new user. A local user whose email was never verified may have been signed up by
+//someone else to catch the real owner's first login, so that is refused with
+//errUnverifiedAccount and the owner has to link from a logged in session instead.
+func linkExternalIdentity(provider string, claims *idTokenClaims) (string, error) {
+	var userID string
+	err := DB.QueryRow("SELECT userId FROM external_identities WHERE provider = ? AND subject = ?", provider, claims.Subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	//Only trust the email when the provider says it verified it. An unverified one isn't
+	//stored on the user either, users.email isn't unique and a second row with someone
+	//else's address would catch their resets and sign in links.
+	email := ""
+	if claims.Email != "" && claims.EmailVerified {
+		email = claims.Email
+		var verified bool
+		err = DB.QueryRow("SELECT userId, verified FROM users WHERE email = ?", email).Scan(&userID, &verified)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		if userID != "" && !verified {
+			return "", errUnverifiedAccount
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if userID == "" {
+		//SSO users have no password, signin can never match an empty hash
+		userID = uuid.New().String()
+		_, err = tx.Exec("INSERT INTO users (username, email, hashedPassword, verified, userID) VALUES (?, ?, '', ?, ?)", ssoUsername(claims.Email), email, email != "", userID)
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO external_identities (provider, subject, userId, email, createdAt) VALUES (?, ?, ?, ?, ?)", provider, claims.Subject, userID, claims.Email, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+//ssoUsername makes up a username from the email, with a random suffix so it is unique
+func ssoUsername(email string) string {
+	name := usernameCleaner.ReplaceAllString(strings.SplitN(email, "@", 2)[0], "")
+	if len(name) > 12 {
+		name = name[:12]
+	}
+	if name == "" {
+		name = "user"
+	}
+	return name + "_" + GetRandomBase62(6)
+}
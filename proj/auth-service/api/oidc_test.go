@@ -0,0 +1,410 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const mockRedirectURI = "http://localhost:3000/oidc/callback"
+
+//mockProvider is a stand-in OpenID Connect provider. It logs in every visitor as the
+//configured subject without asking.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	codes    map[string]mockCode
+	subject  string
+	email    string
+	verified bool
+	//issuer, audience and nonce replace the right values in the next ID tokens
+	issuer   string
+	audience string
+	nonce    string
+}
+
+//mockCode is what an issued authorization code was for
+type mockCode struct {
+	ClientID    string
+	RedirectURI string
+	Nonce       string
+	Challenge   string
+}
+
+//newMockProvider starts a provider and configures auth-service to use it as "mock"
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, codes: map[string]mockCode{}, verified: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	//A new subject and email every time, so tests don't see each other's accounts
+	p.subject = "mock-" + GetRandomBase62(8)
+	p.email = p.subject + "@example.com"
+
+	t.Setenv("OIDC_PROVIDERS", "mock")
+	t.Setenv("OIDC_MOCK_ISSUER", p.URL)
+	t.Setenv("OIDC_MOCK_CLIENT_ID", "bearchat")
+	t.Setenv("OIDC_MOCK_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_MOCK_REDIRECT_URI", mockRedirectURI)
+	err = InitOIDCProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { oidcProviders = map[string]*oidcProvider{} })
+	return p
+}
+
+func (p *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+	})
+}
+
+func (p *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]map[string]string{"keys": {{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": "mock",
+		"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}})
+}
+
+//authorize approves straight away and sends the browser back with a code
+func (p *mockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("response_type") != "code" || query.Get("client_id") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := GetRandomBase62(24)
+	p.mu.Lock()
+	p.codes[code] = mockCode{
+		ClientID:    query.Get("client_id"),
+		RedirectURI: query.Get("redirect_uri"),
+		Nonce:       query.Get("nonce"),
+		Challenge:   query.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+//token redeems a code for a signed ID token
+func (p *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		mockTokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	if !ok || pending.ClientID != r.PostForm.Get("client_id") || pending.RedirectURI != r.PostForm.Get("redirect_uri") {
+		mockTokenError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != pending.Challenge {
+		mockTokenError(w, "invalid_grant")
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            p.URL,
+		"sub":            p.subject,
+		"aud":            pending.ClientID,
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          pending.Nonce,
+		"email":          p.email,
+		"email_verified": p.verified,
+	}
+	for claim, value := range map[string]string{"iss": p.issuer, "aud": p.audience, "nonce": p.nonce} {
+		if value != "" {
+			claims[claim] = value
+		}
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = "mock"
+	signed, err := idToken.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": GetRandomBase62(24),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func mockTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+//login runs the browser's part of the flow: it starts a login at auth-service, lets the
+//provider approve it and posts the code to target, the callback or the link route
+func (p *mockProvider) login(t *testing.T, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	w := request(t, http.MethodGet, "/api/auth/oidc/mock/login", nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d %s", w.Code, w.Body.String())
+	}
+	cookies = append(cookies, w.Result().Cookies()...)
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Scheme+"://"+back.Host+back.Path != mockRedirectURI {
+		t.Fatalf("provider sent the browser to %s", back)
+	}
+
+	return request(t, http.MethodPost, target, map[string]string{
+		"code":  back.Query().Get("code"),
+		"state": back.Query().Get("state"),
+	}, cookies...)
+}
+
+//loggedInAs returns the user the access token cookie of the response was issued to
+func loggedInAs(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "access_token" {
+			claims, err := getClaims(cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return claims.UserID
+		}
+	}
+	t.Fatalf("no access token was set: %d %s", w.Code, w.Body.String())
+	return ""
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	p := newMockProvider(t)
+
+	w := request(t, http.MethodGet, "/api/auth/oidc/providers", nil)
+	var names []string
+	json.NewDecoder(w.Body).Decode(&names)
+	if len(names) != 1 || names[0] != "mock" {
+		t.Errorf("got providers %v", names)
+	}
+
+	config, err := oidcProviders["mock"].discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TokenEndpoint != p.URL+"/token" || config.JWKSURI != p.URL+"/jwks" {
+		t.Errorf("got %+v", config)
+	}
+
+	//A discovery document about another issuer is refused
+	impostorServer := httptest.NewServer(http.HandlerFunc(p.discovery))
+	defer impostorServer.Close()
+	impostor := &oidcProvider{Name: "impostor", Issuer: impostorServer.URL}
+	_, err = impostor.discover()
+	if err == nil {
+		t.Error("discovery accepted a document for another issuer")
+	}
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+
+	w := p.login(t, "/api/auth/oidc/mock/callback")
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: got %d %s", w.Code, w.Body.String())
+	}
+	userID := loggedInAs(t, w)
+
+	var email string
+	var verified bool
+	err := DB.QueryRow("SELECT email, verified FROM users WHERE userId = ?", userID).Scan(&email, &verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != p.email || !verified {
+		t.Errorf("got user with %s, verified %v", email, verified)
+	}
+
+	//The next login finds the same user through the linked identity
+	w = p.login(t, "/api/auth/oidc/mock/callback")
+	if again := loggedInAs(t, w); again != userID {
+		t.Errorf("second login got user %s, want %s", again, userID)
+	}
+}
+
+func TestOIDCRejectsBadIDToken(t *testing.T) {
+	for name, set := range map[string]func(p *mockProvider){
+		"nonce":    func(p *mockProvider) { p.nonce = "replayed" },
+		"audience": func(p *mockProvider) { p.audience = "another-app" },
+		"issuer":   func(p *mockProvider) { p.issuer = "https://evil.example.com" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			resetLimits()
+			p := newMockProvider(t)
+			set(p)
+
+			w := p.login(t, "/api/auth/oidc/mock/callback")
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("got %d %s, want 401", w.Code, w.Body.String())
+			}
+			var exists bool
+			DB.QueryRow("SELECT EXISTS (SELECT * FROM external_identities WHERE subject = ?)", p.subject).Scan(&exists)
+			if exists {
+				t.Error("the identity was linked anyway")
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackNeedsStateCookie(t *testing.T) {
+	resetLimits()
+	newMockProvider(t)
+
+	//A callback posted from a browser that didn't start the login has no state cookie
+	w := request(t, http.MethodGet, "/api/auth/oidc/mock/login", nil)
+	state, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = request(t, http.MethodPost, "/api/auth/oidc/mock/callback", map[string]string{"code": "anything", "state": state.Query().Get("state")})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d %s, want 400", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCLinksVerifiedAccount(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+	user := signupUser(t, "ssolinked")
+	_, err := DB.Exec("UPDATE users SET verified = TRUE WHERE userId = ?", user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.email = user.Email
+
+	w := p.login(t, "/api/auth/oidc/mock/callback")
+	if got := loggedInAs(t, w); got != user.UserID {
+		t.Errorf("logged in as %s, want the existing user %s", got, user.UserID)
+	}
+}
+
+func TestOIDCRefusesUnverifiedAccount(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+	user := signupUser(t, "ssoowner")
+	p.email = user.Email
+
+	//Someone else may have signed up with the address, so the login isn't linked to it
+	w := p.login(t, "/api/auth/oidc/mock/callback")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got %d %s, want 409", w.Code, w.Body.String())
+	}
+
+	//The owner links the provider from their session instead, and can log in with it after
+	w = p.login(t, "/api/auth/oidc/mock/link", user.Cookies...)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("link: got %d %s", w.Code, w.Body.String())
+	}
+	w = p.login(t, "/api/auth/oidc/mock/callback")
+	if got := loggedInAs(t, w); got != user.UserID {
+		t.Errorf("logged in as %s, want the linking user %s", got, user.UserID)
+	}
+
+	//The provider account can't be linked to a second user
+	other := signupUser(t, "ssoother")
+	w = p.login(t, "/api/auth/oidc/mock/link", other.Cookies...)
+	if w.Code != http.StatusConflict {
+		t.Errorf("linking to another user: got %d %s, want 409", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCUnverifiedEmailIsNotStored(t *testing.T) {
+	resetLimits()
+	p := newMockProvider(t)
+	victim := signupUser(t, "ssovictim")
+	p.email = victim.Email
+	p.verified = false
+
+	//The provider account gets a user of its own, without the address it couldn't vouch for
+	w := p.login(t, "/api/auth/oidc/mock/callback")
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: got %d %s", w.Code, w.Body.String())
+	}
+	userID := loggedInAs(t, w)
+	if userID == victim.UserID {
+		t.Fatal("logged in as the user with the unverified email")
+	}
+	var email string
+	var verified bool
+	err := DB.QueryRow("SELECT email, verified FROM users WHERE userId = ?", userID).Scan(&email, &verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != "" || verified {
+		t.Errorf("got user with %q, verified %v, want no email", email, verified)
+	}
+
+	//The address still resolves to the one user who signed up with it
+	var users int
+	err = DB.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", victim.Email).Scan(&users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users != 1 {
+		t.Errorf("got %d users with %s, want 1", users, victim.Email)
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/google/uuid"
+)
+
+var (
+	//postsServiceURL and profilesServiceURL are where outbox events are delivered
+	postsServiceURL    = "http://172.28.1.3"
+	profilesServiceURL = "http://172.28.1.4"
+	//internalAPIKey authenticates auth-service to the internal routes of the other services
+	internalAPIKey = ""
+
+	internalClient = &http.Client{Timeout: 5 * time.Second}
+
+	//outboxLease is how long a delivery may take before another worker picks the event up again
+	outboxLease = time.Minute
+	//outboxMaxBackoff caps the wait between retries of a failing event
+	outboxMaxBackoff = time.Hour
+)
+
+const (
+	targetPosts    = "posts"
+	targetProfiles = "profiles"
+)
+
+//execer is implemented by both *sql.DB and *sql.Tx, so events can be written in the
+//same transaction as the change they announce
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+//outboxEvent is a call to another service that has to happen eventually. Events are
+//stored in the same database as the change they belong to and retried until the
+//target service accepts them, so an outage only delays them.
+type outboxEvent struct {
+	EventID   string
+	JobID     string
+	EventType string
+	Target    string
+	Method    string
+	Path      string
+	Payload   string
+	Attempts  int
+}
+
+//enqueueEvent stores an event for the worker to deliver
+func enqueueEvent(db execer, jobID string, eventType string, target string, method string, path string, payload string) error {
+	now := time.Now()
+	_, err := db.Exec("INSERT INTO outbox_events (eventId, jobId, eventType, target, method, path, payload, createdAt, attempts, nextAttemptAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?)",
+		uuid.New().String(), jobID, eventType, target, method, path, payload, now, now)
+	return err
+}
+
+//StartOutboxWorker delivers due outbox events every interval until the process exits
+func StartOutboxWorker(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			err := deliverDueEvents()
+			if err != nil {
+				log.Print("error delivering outbox events: " + err.Error())
+			}
+		}
+	}()
+}
+
+//deliverDueEvents tries every event whose next attempt is due
+func deliverDueEvents() error {
+	now := time.Now()
+	rows, err := DB.Query("SELECT eventId, jobId, eventType, target, method, path, payload, attempts FROM outbox_events WHERE completedAt IS NULL AND nextAttemptAt <= ? ORDER BY nextAttemptAt LIMIT 50", now)
+	if err != nil {
+		return err
+	}
+	var events []outboxEvent
+	for rows.Next() {
+		var e outboxEvent
+		err = rows.Scan(&e.EventID, &e.JobID, &e.EventType, &e.Target, &e.Method, &e.Path, &e.Payload, &e.Attempts)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		//Lease the event first so other replicas skip it while we deliver
+		res, err := DB.Exec("UPDATE outbox_events SET nextAttemptAt = ? WHERE eventId = ? AND completedAt IS NULL AND nextAttemptAt <= ?", now.Add(outboxLease), e.EventID, now)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		deliverErr := deliverEvent(e)
+		if deliverErr == nil {
+			_, err = DB.Exec("UPDATE outbox_events SET completedAt = ?, attempts = attempts + 1, lastError = NULL WHERE eventId = ?", time.Now(), e.EventID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		//Back off exponentially, a service that is down for a while isn't hammered
+		backoff := time.Second << uint(e.Attempts)
+		if backoff > outboxMaxBackoff || backoff <= 0 {
+			backoff = outboxMaxBackoff
+		}
+		log.Printf("delivering %s event %s to %s failed, retrying in %s: %s", e.EventType, e.EventID, e.Target, backoff, deliverErr.Error())
+		_, err = DB.Exec("UPDATE outbox_events SET attempts = attempts + 1, nextAttemptAt = ?, lastError = ? WHERE eventId = ?", time.Now().Add(backoff), deliverErr.Error(), e.EventID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//deliverEvent calls the internal route of the target service
+func deliverEvent(e outboxEvent) error {
+	var base string
+	switch e.Target {
+	case targetPosts:
+		base = postsServiceURL
+	case targetProfiles:
+		base = profilesServiceURL
+	default:
+		return fmt.Errorf("unknown outbox target %q", e.Target)
+	}
+
+	req, err := http.NewRequest(e.Method, base+e.Path, bytes.NewReader([]byte(e.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(authn.InternalKeyHeader, internalAPIKey)
+
+	resp, err := internalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s service responded with status %d", e.Target, resp.StatusCode)
+	}
+	return nil
+}
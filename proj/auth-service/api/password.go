@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//bcryptMaxBytes is where bcrypt stops reading, anything after it is silently ignored
+const bcryptMaxBytes = 72
+
+//Rules a password can fail
+const (
+	ruleMinLength   = "min_length"
+	ruleMaxBytes    = "max_bytes"
+	ruleCharClasses = "character_classes"
+	ruleBreached    = "breached"
+)
+
+//passwordPolicy is the policy new passwords are checked against, see InitPasswordPolicy
+var passwordPolicy = PasswordPolicy{MinLength: 8, MaxBytes: bcryptMaxBytes}
+
+//PasswordPolicy is what a new password has to satisfy
+type PasswordPolicy struct {
+	//MinLength is counted in characters, not bytes
+	MinLength int
+	//MaxBytes can't be more than bcryptMaxBytes
+	MaxBytes int
+	//MinClasses is how many of lowercase, uppercase, digits and symbols are needed, 0 to not care
+	MinClasses int
+	//BreachedDir holds the breached password hashes, empty to skip screening
+	BreachedDir string
+}
+
+//PolicyViolation is one rule a password failed
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+//InitPasswordPolicy reads the policy from PASSWORD_MIN_LENGTH, PASSWORD_MAX_BYTES,
+//PASSWORD_MIN_CLASSES and BREACHED_PASSWORDS_DIR, keeping the defaults for unset ones.
+func InitPasswordPolicy() error {
+	policy := passwordPolicy
+	for env, field := range map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &policy.MinLength,
+		"PASSWORD_MAX_BYTES":   &policy.MaxBytes,
+		"PASSWORD_MIN_CLASSES": &policy.MinClasses,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative number", env)
+		}
+		*field = n
+	}
+	if policy.MaxBytes < 1 || policy.MaxBytes > bcryptMaxBytes {
+		return fmt.Errorf("PASSWORD_MAX_BYTES must be between 1 and %d", bcryptMaxBytes)
+	}
+	if policy.MinClasses > 4 {
+		return errors.New("PASSWORD_MIN_CLASSES can be at most 4")
+	}
+	policy.BreachedDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+	passwordPolicy = policy
+	return nil
+}
+
+//Check returns the rules the password fails, if any
+func (p PasswordPolicy) Check(password string) ([]PolicyViolation, error) {
+	violations := []PolicyViolation{}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PolicyViolation{ruleMinLength, fmt.Sprintf("must be at least %d characters long", p.MinLength)})
+	}
+	if len(password) > p.MaxBytes {
+		violations = append(violations, PolicyViolation{ruleMaxBytes, fmt.Sprintf("must be at most %d bytes long", p.MaxBytes)})
+	}
+	if p.MinClasses > 0 && characterClasses(password) < p.MinClasses {
+		violations = append(violations, PolicyViolation{ruleCharClasses, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses)})
+	}
+	if p.BreachedDir != "" {
+		breached, err := isBreached(p.BreachedDir, password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, PolicyViolation{ruleBreached, "has appeared in a data breach, please choose another"})
+		}
+	}
+	return violations, nil
+}
+
+//characterClasses counts how many of lowercase, uppercase, digits and symbols the password uses
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+//isBreached looks the password up in a directory laid out like the Pwned Passwords range API.
+//The uppercase hex SHA-1 of the password is split after 5 characters, the file named after
+//the prefix (e.g. 5BAA6.txt) lists the suffixes in that range as SUFFIX:COUNT lines. Only
+//that one file is read, and a missing file means no breached password has the prefix.
+func isBreached(dir string, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.EqualFold(strings.SplitN(line, ":", 2)[0], suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+//checkPassword writes a 400 listing the failed rules and returns false if the password
+//doesn't meet the policy
+func checkPassword(w http.ResponseWriter, password string) bool {
+	violations, err := passwordPolicy.Check(password)
+	if err != nil {
+		http.Error(w, errors.New("error checking password").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return false
+	}
+	if len(violations) == 0 {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "password does not meet the policy",
+		"violations": violations,
+	})
+	return false
+}
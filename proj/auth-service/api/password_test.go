@@ -0,0 +1,113 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//violatedRules signs up with the password and returns the rules it was refused for
+func violatedRules(t *testing.T, password string) []string {
+	t.Helper()
+	suffix := GetRandomBase62(8)
+	w := request(t, http.MethodPost, "/api/auth/signup", Credentials{Username: "policy" + suffix, Email: "policy" + suffix + "@example.com", Password: password})
+	if w.Code == http.StatusCreated {
+		return nil
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("signup: got %d %s", w.Code, w.Body.String())
+	}
+	var refusal struct {
+		Violations []PolicyViolation `json:"violations"`
+	}
+	decode(t, w, &refusal)
+	rules := []string{}
+	for _, violation := range refusal.Violations {
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+//breachedDir writes a breached password directory holding the passwords
+func breachedDir(t *testing.T, passwords ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		err := ioutil.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte("0000000000000000000000000000000000A:1\r\n"+hash[5:]+":3861493\r\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSignupPasswordPolicy(t *testing.T) {
+	resetLimits()
+	saved := passwordPolicy
+	defer func() { passwordPolicy = saved }()
+	passwordPolicy.MinClasses = 3
+	passwordPolicy.BreachedDir = breachedDir(t, "Password1!")
+
+	for _, c := range []struct {
+		password string
+		want     string
+	}{
+		{"Sh0rt!", ruleMinLength},
+		//Length is counted in characters, these are 7 of them in 14 bytes
+		{"Ééééé1!", ruleMinLength},
+		{strings.Repeat("Aa1!", 18) + "x", ruleMaxBytes},
+		{"onlylowercaseletters", ruleCharClasses},
+		{"Password1!", ruleBreached},
+		{"Correct Horse 9", ""},
+	} {
+		rules := violatedRules(t, c.password)
+		if c.want == "" && len(rules) != 0 || c.want != "" && (len(rules) != 1 || rules[0] != c.want) {
+			t.Errorf("%q: got %v, want %q", c.password, rules, c.want)
+		}
+	}
+
+	//Every rule failed is listed
+	if rules := violatedRules(t, "short"); len(rules) != 2 {
+		t.Errorf("got %v, want min_length and character_classes", rules)
+	}
+}
+
+func TestResetPasswordPolicy(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "resetpolicy")
+	request(t, http.MethodPost, "/api/auth/sendreset", Credentials{Username: user.Username, Email: user.Email, Password: "unused"})
+	token := emailedToken(t, user, "password-reset.html")
+
+	//A refused password doesn't use up the link
+	w := request(t, http.MethodPost, "/api/auth/resetpw?token="+token, Credentials{Username: user.Username, Email: user.Email, Password: "short"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ruleMinLength) {
+		t.Fatalf("weak password: got %d %s, want 400 with the violation", w.Code, w.Body.String())
+	}
+	w = request(t, http.MethodPost, "/api/auth/resetpw?token="+token, Credentials{Username: user.Username, Email: user.Email, Password: "long enough now"})
+	if w.Code != http.StatusOK {
+		t.Errorf("strong password: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestInitPasswordPolicyRejectsBadSettings(t *testing.T) {
+	saved := passwordPolicy
+	defer func() { passwordPolicy = saved }()
+	for env, value := range map[string]string{
+		"PASSWORD_MAX_BYTES":   "73",
+		"PASSWORD_MIN_CLASSES": "5",
+		"PASSWORD_MIN_LENGTH":  "-1",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if err := InitPasswordPolicy(); err == nil {
+				t.Errorf("%s=%s: got no error", env, value)
+			}
+		})
+	}
+}
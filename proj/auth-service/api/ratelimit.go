@@ -0,0 +1,330 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	//ipLimiter slows down password guessing and email spamming from a single address
+	ipLimiter *RateLimiter
+	//accountLimiter locks an account after too many wrong passwords
+	accountLimiter *RateLimiter
+	//resetLimiter stops reset emails from being used to spam someone's inbox
+	resetLimiter *RateLimiter
+
+	//attemptStore is the store the limiters share, the token janitor prunes it
+	attemptStore AttemptStore
+)
+
+//InitRateLimiters sets up the limiters on the given store
+func InitRateLimiters(store AttemptStore) {
+	attemptStore = store
+	ipLimiter = &RateLimiter{store: store, Limit: 20, Window: 15 * time.Minute, BaseLockout: time.Minute, MaxLockout: time.Hour}
+	accountLimiter = &RateLimiter{store: store, Limit: 5, Window: 15 * time.Minute, BaseLockout: time.Minute, MaxLockout: time.Hour}
+	resetLimiter = &RateLimiter{store: store, Limit: 3, Window: time.Hour, BaseLockout: 15 * time.Minute, MaxLockout: 24 * time.Hour}
+}
+
+//AttemptStore keeps the counters of the rate limiters. The SQL implementation shares
+//them between auth-service replicas.
+type AttemptStore interface {
+	//AddAttempt records an attempt for the key and forgets the ones made before prune
+	AddAttempt(key string, at time.Time, prune time.Time) error
+	//CountAttempts returns the number of attempts for the key since the given time
+	CountAttempts(key string, since time.Time) (int, error)
+	//Lockout returns when the current lockout of the key ends and how many lockouts it has had
+	Lockout(key string) (until time.Time, lockouts int, err error)
+	//SetLockout locks the key out until the given time
+	SetLockout(key string, until time.Time, lockouts int) error
+	//Reset forgets every attempt and lockout of the key
+	Reset(key string) error
+	//DeleteExpired forgets the attempts made before the given time and the lockouts that
+	//ended before it, of every key
+	DeleteExpired(before time.Time) (int64, error)
+}
+
+//RateLimiter allows Limit attempts per key within a sliding Window. Going over it locks
+//the key out, for BaseLockout the first time and twice as long every time after that,
+//up to MaxLockout.
+type RateLimiter struct {
+	store       AttemptStore
+	Limit       int
+	Window      time.Duration
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+//Check returns how long the key is still locked out for, 0 if it may make an attempt
+func (l *RateLimiter) Check(key string) (time.Duration, error) {
+	until, _, err := l.store.Lockout(key)
+	if err != nil {
+		return 0, err
+	}
+	if wait := time.Until(until); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+//Record counts an attempt against the key and locks it out once it goes over the limit
+func (l *RateLimiter) Record(key string) error {
+	now := time.Now()
+	err := l.store.AddAttempt(key, now, now.Add(-l.Window))
+	if err != nil {
+		return err
+	}
+	count, err := l.store.CountAttempts(key, now.Add(-l.Window))
+	if err != nil {
+		return err
+	}
+	if count < l.Limit {
+		return nil
+	}
+
+	until, lockouts, err := l.store.Lockout(key)
+	if err != nil {
+		return err
+	}
+	//the backoff starts over once the key has behaved for a whole window
+	if now.Sub(until) > l.Window {
+		lockouts = 0
+	}
+	lockout := time.Duration(float64(l.BaseLockout) * math.Pow(2, float64(lockouts)))
+	if lockout > l.MaxLockout || lockout <= 0 {
+		lockout = l.MaxLockout
+	}
+	return l.store.SetLockout(key, now.Add(lockout), lockouts+1)
+}
+
+//Reset clears the key, e.g. after a successful sign in
+func (l *RateLimiter) Reset(key string) error {
+	return l.store.Reset(key)
+}
+
+//limitsExpiredBefore is when attempts and lockouts stop counting for every limiter. Attempts
+//older than the longest window aren't counted, and a lockout that ended a window ago no
+//longer adds to the backoff.
+func limitsExpiredBefore() time.Time {
+	longest := time.Duration(0)
+	for _, l := range []*RateLimiter{ipLimiter, accountLimiter, resetLimiter} {
+		if l.Window > longest {
+			longest = l.Window
+		}
+	}
+	return time.Now().Add(-longest)
+}
+
+//limitKey is a key checked against a particular limiter
+type limitKey struct {
+	limiter *RateLimiter
+	key     string
+}
+
+//checkLimits writes a 429 with Retry-After and returns false if any of the keys is locked out
+func checkLimits(w http.ResponseWriter, keys ...limitKey) bool {
+	var wait time.Duration
+	for _, k := range keys {
+		d, err := k.limiter.Check(k.key)
+		if err != nil {
+			http.Error(w, errors.New("error checking rate limit").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return false
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, errors.New("too many attempts, try again later").Error(), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+//recordAttempts counts an attempt against each of the keys
+func recordAttempts(keys ...limitKey) {
+	for _, k := range keys {
+		err := k.limiter.Record(k.key)
+		if err != nil {
+			log.Print("error recording attempt: " + err.Error())
+		}
+	}
+}
+
+//clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//SQLAttemptStore keeps the counters in the auth database
+type SQLAttemptStore struct {
+	db *sql.DB
+}
+
+//NewSQLAttemptStore returns an AttemptStore backed by the given database
+func NewSQLAttemptStore(db *sql.DB) *SQLAttemptStore {
+	return &SQLAttemptStore{db: db}
+}
+
+func (s *SQLAttemptStore) AddAttempt(key string, at time.Time, prune time.Time) error {
+	_, err := s.db.Exec("DELETE FROM rate_limit_attempts WHERE attemptKey = ? AND attemptedAt < ?", key, prune)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO rate_limit_attempts (attemptKey, attemptedAt) VALUES (?, ?)", key, at)
+	return err
+}
+
+func (s *SQLAttemptStore) CountAttempts(key string, since time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM rate_limit_attempts WHERE attemptKey = ? AND attemptedAt >= ?", key, since).Scan(&count)
+	return count, err
+}
+
+func (s *SQLAttemptStore) Lockout(key string) (time.Time, int, error) {
+	var until time.Time
+	var lockouts int
+	err := s.db.QueryRow("SELECT lockedUntil, lockouts FROM rate_limit_lockouts WHERE attemptKey = ?", key).Scan(&until, &lockouts)
+	if err == sql.ErrNoRows {
+		return time.Time{}, 0, nil
+	}
+	return until, lockouts, err
+}
+
+func (s *SQLAttemptStore) SetLockout(key string, until time.Time, lockouts int) error {
+	_, err := s.db.Exec("REPLACE INTO rate_limit_lockouts (attemptKey, lockedUntil, lockouts) VALUES (?, ?, ?)", key, until, lockouts)
+	return err
+}
+
+func (s *SQLAttemptStore) Reset(key string) error {
+	_, err := s.db.Exec("DELETE FROM rate_limit_attempts WHERE attemptKey = ?", key)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("DELETE FROM rate_limit_lockouts WHERE attemptKey = ?", key)
+	return err
+}
+
+func (s *SQLAttemptStore) DeleteExpired(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM rate_limit_attempts WHERE attemptedAt < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	attempts, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	res, err = s.db.Exec("DELETE FROM rate_limit_lockouts WHERE lockedUntil < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	lockouts, err := res.RowsAffected()
+	return attempts + lockouts, err
+}
+
+//MemoryAttemptStore keeps the counters in memory, for tests and single-replica development
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+	lockouts map[string]memoryLockout
+}
+
+type memoryLockout struct {
+	until time.Time
+	count int
+}
+
+//NewMemoryAttemptStore returns an empty MemoryAttemptStore
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		attempts: make(map[string][]time.Time),
+		lockouts: make(map[string]memoryLockout),
+	}
+}
+
+func (s *MemoryAttemptStore) AddAttempt(key string, at time.Time, prune time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.attempts[key][:0]
+	for _, t := range s.attempts[key] {
+		if !t.Before(prune) {
+			kept = append(kept, t)
+		}
+	}
+	s.attempts[key] = append(kept, at)
+	return nil
+}
+
+func (s *MemoryAttemptStore) CountAttempts(key string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, t := range s.attempts[key] {
+		if !t.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryAttemptStore) Lockout(key string) (time.Time, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lockout := s.lockouts[key]
+	return lockout.until, lockout.count, nil
+}
+
+func (s *MemoryAttemptStore) SetLockout(key string, until time.Time, lockouts int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockouts[key] = memoryLockout{until: until, count: lockouts}
+	return nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	delete(s.lockouts, key)
+	return nil
+}
+
+func (s *MemoryAttemptStore) DeleteExpired(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, attempts := range s.attempts {
+		kept := attempts[:0]
+		for _, t := range attempts {
+			if t.Before(before) {
+				n++
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.attempts, key)
+		} else {
+			s.attempts[key] = kept
+		}
+	}
+	for key, lockout := range s.lockouts {
+		if lockout.until.Before(before) {
+			delete(s.lockouts, key)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSigninLockout(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "lockout")
+	wrong := Credentials{Username: user.Username, Password: "not my password"}
+
+	for i := 0; i < accountLimiter.Limit; i++ {
+		w := request(t, http.MethodPost, "/api/auth/signin", wrong)
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("locked out after %d attempts, want %d", i, accountLimiter.Limit)
+		}
+	}
+
+	//Locked out, even with the right password
+	w := request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d %s, want 429", w.Code, w.Body.String())
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > int(accountLimiter.BaseLockout.Seconds()) {
+		t.Errorf("got Retry-After %q, want at most %s", w.Header().Get("Retry-After"), accountLimiter.BaseLockout)
+	}
+
+	//Other accounts from the same address are still fine
+	other := signupUser(t, "lockout")
+	w = request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: other.Username, Password: other.Password})
+	if w.Code != http.StatusOK {
+		t.Errorf("another account: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLockoutBacksOff(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	limiter := &RateLimiter{store: store, Limit: 1, Window: time.Hour, BaseLockout: time.Minute, MaxLockout: 3 * time.Minute}
+
+	//Each lockout in a row is twice as long as the one before, up to MaxLockout
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		err := limiter.Record("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait, err := limiter.Check("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait > want || wait < want-time.Second {
+			t.Errorf("got a lockout of %s, want %s", wait, want)
+		}
+	}
+
+	//A lockout that ended a window ago starts the backoff over
+	store.SetLockout("key", time.Now().Add(-2*time.Hour), 3)
+	err := limiter.Record("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := limiter.Check("key"); wait > time.Minute {
+		t.Errorf("got a lockout of %s after behaving, want %s", wait, time.Minute)
+	}
+}
+
+func TestAttemptStoresDeleteExpired(t *testing.T) {
+	for name, store := range map[string]AttemptStore{
+		"sql":    NewSQLAttemptStore(DB),
+		"memory": NewMemoryAttemptStore(),
+	} {
+		prefix := name + GetRandomBase62(8) + ":"
+		now := time.Now()
+		cutoff := now.Add(-time.Hour)
+
+		store.AddAttempt(prefix+"old", now.Add(-2*time.Hour), time.Time{})
+		store.AddAttempt(prefix+"mixed", now.Add(-2*time.Hour), time.Time{})
+		store.AddAttempt(prefix+"mixed", now, time.Time{})
+		store.SetLockout(prefix+"ended", now.Add(-2*time.Hour), 1)
+		store.SetLockout(prefix+"recent", now.Add(-time.Minute), 1)
+
+		_, err := store.DeleteExpired(cutoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]int{"old": 0, "mixed": 1} {
+			count, err := store.CountAttempts(prefix+key, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != want {
+				t.Errorf("%s: got %d attempts for %s, want %d", name, count, key, want)
+			}
+		}
+		if _, lockouts, _ := store.Lockout(prefix + "ended"); lockouts != 0 {
+			t.Errorf("%s: the lockout that ended is still there", name)
+		}
+		if _, lockouts, _ := store.Lockout(prefix + "recent"); lockouts != 1 {
+			t.Errorf("%s: the recent lockout was deleted", name)
+		}
+	}
+}
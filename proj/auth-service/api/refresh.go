@@ -0,0 +1,259 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token is not valid")
+	errRefreshTokenReused  = errors.New("refresh token has already been used")
+	errAccountLocked       = errors.New("this account is locked")
+)
+
+//tokenPair is what a login gets, a short-lived access token and the refresh token that renews it
+type tokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+//issueTokens mints an access and refresh token for the user, records the refresh token
+//and sets both as cookies. The refresh tokens of a session form one token family, an
+//empty sessionID starts a new session (a new login).
+func issueTokens(w http.ResponseWriter, r *http.Request, userID string, sessionID string) error {
+	tokens, err := mintTokens(r, userID, sessionID, "", nil)
+	if err != nil {
+		return err
+	}
+
+	//Set the cookies, name them "access_token" and "refresh_token"
+	http.SetCookie(w, &http.Cookie{
+		Name:    "access_token",
+		Value:   tokens.AccessToken,
+		Expires: tokens.AccessExpiresAt,
+		// Leave these next three values commented for now
+		// Secure: true,
+		// HttpOnly: true,
+		// SameSite: http.SameSiteNoneMode,
+		Path: "/",
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:    "refresh_token",
+		Value:   tokens.RefreshToken,
+		Expires: tokens.RefreshExpiresAt,
+		Path:    "/",
+	})
+	return nil
+}
+
+//mintTokens mints and records the tokens of a session, starting a new session on the
+//request's device when sessionID is empty. Tokens for an OAuth client carry its id and the
+//granted scopes.
+func mintTokens(r *http.Request, userID string, sessionID string, clientID string, scopes []string) (tokenPair, error) {
+	//The other services take the address and roles from the token rather than from request bodies
+	var email string
+	var verified, locked bool
+	err := DB.QueryRow("SELECT email, verified, locked FROM users WHERE userId = ?", userID).Scan(&email, &verified, &locked)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	if locked {
+		return tokenPair{}, errAccountLocked
+	}
+	//A client only gets the scopes the user granted it, never the user's roles
+	var roles []string
+	if clientID == "" {
+		roles, err = loadRoles(userID)
+		if err != nil {
+			return tokenPair{}, err
+		}
+	}
+
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+		userAgent := requestUserAgent(r)
+		err = sessionStore.CreateSession(Session{
+			ID:        sessionID,
+			UserID:    userID,
+			ClientID:  clientID,
+			Device:    deviceName(userAgent),
+			IP:        clientIP(r),
+			UserAgent: userAgent,
+		})
+	} else {
+		err = sessionStore.TouchSession(sessionID, clientIP(r))
+	}
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	//Generate an access token, expiry dates are in Unix time
+	accessExpiresAt := time.Now().Add(DefaultAccessJWTExpiry)
+	accessToken, err := setClaims(AuthClaims{
+		Email:         email,
+		EmailVerified: verified,
+		UserID:        userID,
+		SessionID:     sessionID,
+		Roles:         roles,
+		Scopes:        scopes,
+		ClientID:      clientID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Subject:   "access",
+			ExpiresAt: accessExpiresAt.Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	//Generate a refresh token, its id is what makes it single-use
+	refreshID := uuid.New().String()
+	refreshExpiresAt := time.Now().Add(DefaultRefreshJWTExpiry)
+	refreshToken, err := setClaims(AuthClaims{
+		UserID:    userID,
+		SessionID: sessionID,
+		Scopes:    scopes,
+		ClientID:  clientID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        refreshID,
+			Subject:   "refresh",
+			ExpiresAt: refreshExpiresAt.Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	_, err = DB.Exec("INSERT INTO refresh_tokens (tokenId, familyId, userId, expiresAt, usedAt, revoked) VALUES (?, ?, ?, ?, NULL, FALSE)", refreshID, sessionID, userID, refreshExpiresAt)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	return tokenPair{
+		AccessToken:      accessToken,
+		AccessExpiresAt:  accessExpiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
+
+//consumeRefreshToken marks the refresh token as used and returns its family. Presenting a
+//token that was already used revokes the whole family, since one of the holders is not the user.
+func consumeRefreshToken(tokenID string) (familyID string, err error) {
+	now := time.Now()
+	res, err := DB.Exec("UPDATE refresh_tokens SET usedAt = ? WHERE tokenId = ? AND usedAt IS NULL AND revoked = FALSE AND expiresAt > ?", now, tokenID, now)
+	if err != nil {
+		return "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	var usedAt sql.NullTime
+	err = DB.QueryRow("SELECT familyId, usedAt FROM refresh_tokens WHERE tokenId = ?", tokenID).Scan(&familyID, &usedAt)
+	if err == sql.ErrNoRows {
+		return "", errRefreshTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if n == 1 {
+		return familyID, nil
+	}
+
+	if usedAt.Valid {
+		err = revokeTokenFamily(familyID)
+		if err != nil {
+			return "", err
+		}
+		return "", errRefreshTokenReused
+	}
+	return "", errRefreshTokenInvalid
+}
+
+//revokeTokenFamily revokes every refresh token that descends from the same login, along
+//with the session so that the access tokens minted for it stop working too
+func revokeTokenFamily(familyID string) error {
+	_, err := DB.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE familyId = ?", familyID)
+	if err != nil {
+		return err
+	}
+	return sessionStore.RevokeSession(familyID)
+}
+
+func refresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		http.Error(w, errors.New("error obtaining refresh token cookie").Error(), http.StatusUnauthorized)
+		log.Print(err.Error())
+		return
+	}
+
+	claims, err := getClaims(cookie.Value)
+	if err != nil {
+		http.Error(w, errors.New("error validating refresh token").Error(), http.StatusUnauthorized)
+		log.Print(err.Error())
+		return
+	}
+	//OAuth clients refresh at /oauth/token, a cookie refresh would drop their scopes
+	if claims.Subject != "refresh" || claims.Id == "" || claims.ClientID != "" {
+		http.Error(w, errRefreshTokenInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+	revoked, err := sessionStore.IsRevoked(claims)
+	if err != nil {
+		http.Error(w, errors.New("error checking token revocation").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if revoked {
+		http.Error(w, errors.New("this session has been revoked").Error(), http.StatusUnauthorized)
+		return
+	}
+
+	//Rotate the refresh token, a replayed token kills the whole family
+	familyID, err := consumeRefreshToken(claims.Id)
+	if err == errRefreshTokenInvalid || err == errRefreshTokenReused {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		log.Print(err.Error() + ": " + claims.Id)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error consuming refresh token").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	err = issueTokens(w, r, claims.UserID, familyID)
+	if err == errAccountLocked {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+//cookieNamed returns the cookie of the response with the name, or fails the test
+func cookieNamed(t *testing.T, cookies []*http.Cookie, name string) *http.Cookie {
+	t.Helper()
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	t.Fatalf("no %s cookie was set", name)
+	return nil
+}
+
+//refreshWith posts the refresh token to /api/auth/refresh
+func refreshWith(t *testing.T, refreshToken *http.Cookie) *http.Response {
+	t.Helper()
+	return request(t, http.MethodPost, "/api/auth/refresh", nil, refreshToken).Result()
+}
+
+func TestRefreshRotatesTheToken(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "rotate")
+	first := cookieNamed(t, user.Cookies, "refresh_token")
+
+	resp := refreshWith(t, first)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: got %d", resp.StatusCode)
+	}
+	second := cookieNamed(t, resp.Cookies(), "refresh_token")
+	access := cookieNamed(t, resp.Cookies(), "access_token")
+	if second.Value == first.Value {
+		t.Fatal("the refresh token was not rotated")
+	}
+
+	//The new token keeps the session, so refreshing doesn't start a new login
+	firstClaims, _ := getClaims(first.Value)
+	secondClaims, err := getClaims(second.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondClaims.SessionID != firstClaims.SessionID {
+		t.Errorf("got session %s, want %s", secondClaims.SessionID, firstClaims.SessionID)
+	}
+	if w := request(t, http.MethodGet, "/api/auth/sessions", nil, access); w.Code != http.StatusOK {
+		t.Errorf("the new access token: got %d", w.Code)
+	}
+	if resp := refreshWith(t, second); resp.StatusCode != http.StatusOK {
+		t.Errorf("refreshing again: got %d", resp.StatusCode)
+	}
+}
+
+func TestRefreshTokenReuseRevokesTheFamily(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "reuse")
+	stolen := cookieNamed(t, user.Cookies, "refresh_token")
+
+	resp := refreshWith(t, stolen)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: got %d", resp.StatusCode)
+	}
+	current := cookieNamed(t, resp.Cookies(), "refresh_token")
+	access := cookieNamed(t, resp.Cookies(), "access_token")
+
+	//Someone plays back the old token, one of the two holders isn't the user
+	if resp := refreshWith(t, stolen); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused token: got %d, want 401", resp.StatusCode)
+	}
+	if resp := refreshWith(t, current); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("the latest token of the family: got %d, want 401", resp.StatusCode)
+	}
+	if w := request(t, http.MethodGet, "/api/auth/sessions", nil, access); w.Code != http.StatusUnauthorized {
+		t.Errorf("an access token of the family: got %d, want 401", w.Code)
+	}
+
+	//Other logins of the user aren't affected
+	w := request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if resp := refreshWith(t, cookieNamed(t, w.Result().Cookies(), "refresh_token")); resp.StatusCode != http.StatusOK {
+		t.Errorf("another login: got %d", resp.StatusCode)
+	}
+}
+
+func TestRefreshRejectsOtherTokens(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "refreshbad")
+	access := cookieNamed(t, user.Cookies, "access_token")
+	refreshToken := cookieNamed(t, user.Cookies, "refresh_token")
+
+	//An access token isn't a refresh token
+	if resp := refreshWith(t, &http.Cookie{Name: "refresh_token", Value: access.Value}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("access token: got %d, want 401", resp.StatusCode)
+	}
+	if resp := refreshWith(t, &http.Cookie{Name: "refresh_token", Value: "not a token"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("garbage: got %d, want 401", resp.StatusCode)
+	}
+
+	//The database has the last word on expiry
+	claims, _ := getClaims(refreshToken.Value)
+	_, err := DB.Exec("UPDATE refresh_tokens SET expiresAt = ? WHERE tokenId = ?", time.Now().Add(-time.Minute), claims.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := refreshWith(t, refreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expired token: got %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//introspectActive asks introspect whether the token is still good
+func introspectActive(t *testing.T, token string) bool {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/introspect", map[string]string{"token": token})
+	if w.Code != http.StatusOK {
+		t.Fatalf("introspect: got %d %s", w.Code, w.Body.String())
+	}
+	var response introspectionResponse
+	decode(t, w, &response)
+	return response.Active
+}
+
+//sessionStores runs the test against each SessionStore, with the handlers using it
+func sessionStores(t *testing.T, test func(t *testing.T, store SessionStore)) {
+	saved := sessionStore
+	defer func() { sessionStore = saved }()
+	for name, store := range map[string]SessionStore{
+		"sql":    NewSQLSessionStore(DB),
+		"memory": NewMemorySessionStore(),
+	} {
+		sessionStore = store
+		t.Run(name, func(t *testing.T) { test(t, store) })
+	}
+}
+
+func TestLogoutRevokesTheSession(t *testing.T) {
+	sessionStores(t, func(t *testing.T, store SessionStore) {
+		resetLimits()
+		user := signupUser(t, "logout")
+		access := cookieNamed(t, user.Cookies, "access_token")
+		if !introspectActive(t, access.Value) {
+			t.Fatal("the access token is not active before logging out")
+		}
+
+		w := request(t, http.MethodPost, "/api/auth/logout", nil, user.Cookies...)
+		if w.Code != http.StatusOK {
+			t.Fatalf("logout: got %d %s", w.Code, w.Body.String())
+		}
+
+		//The copied tokens stop working even though they haven't expired
+		if introspectActive(t, access.Value) {
+			t.Error("introspect still accepts the access token")
+		}
+		if w := request(t, http.MethodGet, "/api/auth/sessions", nil, access); w.Code != http.StatusUnauthorized {
+			t.Errorf("the access token: got %d, want 401", w.Code)
+		}
+		if resp := refreshWith(t, cookieNamed(t, user.Cookies, "refresh_token")); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("the refresh token: got %d, want 401", resp.StatusCode)
+		}
+	})
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	sessionStores(t, func(t *testing.T, store SessionStore) {
+		resetLimits()
+		user := signupUser(t, "revokeall")
+		w := request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+		other := cookieNamed(t, w.Result().Cookies(), "access_token")
+
+		w = request(t, http.MethodPost, "/api/auth/sessions/revoke-all", nil, user.Cookies...)
+		if w.Code != http.StatusOK {
+			t.Fatalf("revoke all: got %d %s", w.Code, w.Body.String())
+		}
+		for name, token := range map[string]string{"this login": cookieNamed(t, user.Cookies, "access_token").Value, "the other login": other.Value} {
+			if introspectActive(t, token) {
+				t.Errorf("%s is still active", name)
+			}
+		}
+	})
+}
+
+func TestDenylist(t *testing.T) {
+	sessionStores(t, func(t *testing.T, store SessionStore) {
+		session := Session{ID: uuid.New().String(), UserID: uuid.New().String(), Device: "test"}
+		err := store.CreateSession(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		denied := AuthClaims{SessionID: session.ID}
+		denied.Id = uuid.New().String()
+		expired := AuthClaims{SessionID: session.ID}
+		expired.Id = uuid.New().String()
+		allowed := AuthClaims{SessionID: session.ID}
+		allowed.Id = uuid.New().String()
+
+		store.RevokeToken(denied.Id, time.Now().Add(time.Hour))
+		store.RevokeToken(expired.Id, time.Now().Add(-time.Minute))
+		for _, c := range []struct {
+			name   string
+			claims AuthClaims
+			want   bool
+		}{{"denied", denied, true}, {"expired", expired, true}, {"allowed", allowed, false}} {
+			if revoked, err := store.IsRevoked(c.claims); err != nil || revoked != c.want {
+				t.Errorf("%s token: got revoked %v (%v), want %v", c.name, revoked, err, c.want)
+			}
+		}
+
+		//The janitor drops tokens that are rejected for being expired anyway
+		n, err := store.DeleteExpiredRevocations()
+		if err != nil || n < 1 {
+			t.Errorf("got %d deleted (%v), want the expired one", n, err)
+		}
+		if revoked, _ := store.IsRevoked(denied); !revoked {
+			t.Error("a token that hasn't expired left the denylist")
+		}
+
+		//Revoking the session covers every token in it, and unknown sessions aren't trusted
+		store.RevokeSession(session.ID)
+		if revoked, _ := store.IsRevoked(allowed); !revoked {
+			t.Error("a token of a revoked session is still good")
+		}
+		if revoked, _ := store.IsRevoked(AuthClaims{SessionID: uuid.New().String()}); !revoked {
+			t.Error("a token of an unknown session is good")
+		}
+	})
+}
@@ -1,53 +1,40 @@
 package api
 
 import (
-	"bytes"
-	"html/template"
-	"os"
+	"fmt"
 
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
 var (
-	sendgridKey    string
-	sendgridClient *sendgrid.Client
-	defaultSender  = mail.NewEmail("CloudComputing Decal", "cathyhan@berkeley.edu")
-	defaultScheme  = "http"
+	defaultSender = mail.NewEmail("CloudComputing Decal", "cathyhan@berkeley.edu")
+	defaultScheme = "http"
 )
 
-//InitMailer initalizes the sendgrid client
-func InitMailer() {
-	// load environmental variables
-	sendgridKey = os.Getenv("SENDGRID_KEY")
-	sendgridClient = sendgrid.NewSendClient(sendgridKey)
+//SendGridMailer delivers email through the SendGrid API
+type SendGridMailer struct {
+	client *sendgrid.Client
+	sender *mail.Email
 }
 
-//SendEmail sends an email to the recipient with the specified subject
-func SendEmail(recipient string, subject string, templatePath string, data map[string]interface{}) error {
-	// Parse template file and execute with data.
-	var html bytes.Buffer
-	tmpl, err := template.ParseFiles("./api/templates/" + templatePath)
-	if err != nil {
-		return err
-	}
-	err = tmpl.Execute(&html, data)
-	if err != nil {
-		return err
-	}
-
-	//turn our html page buffer into a string
-	plainTextContent := html.String()
+//NewSendGridMailer returns a SendGridMailer that authenticates with the given API key
+func NewSendGridMailer(key string) *SendGridMailer {
+	return &SendGridMailer{client: sendgrid.NewSendClient(key), sender: defaultSender}
+}
 
-	recipientEmail := mail.NewEmail("recipient", recipient)
+func (m *SendGridMailer) Send(email Email) error {
+	recipientEmail := mail.NewEmail("recipient", email.Recipient)
 
 	// Construct and send email via Sendgrid.
-	message := mail.NewSingleEmail(defaultSender, subject, recipientEmail, plainTextContent, html.String())
+	message := mail.NewSingleEmail(m.sender, email.Subject, recipientEmail, email.HTML, email.HTML)
 
-	_, err = sendgridClient.Send(message)
+	response, err := m.client.Send(message)
 	if err != nil {
 		return err
 	}
-
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid responded with status %d: %s", response.StatusCode, response.Body)
+	}
 	return nil
 }
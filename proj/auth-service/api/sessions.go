@@ -0,0 +1,475 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/gorilla/mux"
+)
+
+//sessionStore is the store used by the handlers to create and revoke sessions
+var sessionStore SessionStore
+
+//Session is one login of a user, either to BearChat itself or through an OAuth client.
+//CreatedAt and LastUsedAt are filled in by the store.
+type Session struct {
+	ID         string
+	UserID     string
+	ClientID   string
+	Device     string
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+//SessionStore keeps track of logins and revoked tokens so that a token can be
+//rejected before its ExpiresAt
+type SessionStore interface {
+	//CreateSession records a new login for the user
+	CreateSession(session Session) error
+	//TouchSession records that the session was just used from the IP
+	TouchSession(sessionID string, ip string) error
+	//ListSessions returns the logins of the user that haven't been revoked or gone stale,
+	//newest first
+	ListSessions(userID string) ([]Session, error)
+	//RevokeSession revokes one login and every token minted for it
+	RevokeSession(sessionID string) error
+	//RevokeAllSessions revokes every login of the user
+	RevokeAllSessions(userID string) error
+	//RevokeClientSessions revokes every login of the user through the OAuth client
+	RevokeClientSessions(userID string, clientID string) error
+	//RevokeToken puts a single token on the denylist until it expires
+	RevokeToken(jti string, expiresAt time.Time) error
+	//IsRevoked reports whether the token or the session it belongs to was revoked
+	IsRevoked(claims AuthClaims) (bool, error)
+	//DeleteStaleSessions removes the logins that weren't used since before
+	DeleteStaleSessions(before time.Time) (int64, error)
+	//DeleteExpiredRevocations drops the denylisted tokens that have expired anyway
+	DeleteExpiredRevocations() (int64, error)
+}
+
+//staleBefore is when a session last has to have been used to still be active. Refreshing
+//is what keeps it in use, so one left alone longer than a refresh token lives is over.
+func staleBefore() time.Time {
+	return time.Now().Add(-DefaultRefreshJWTExpiry)
+}
+
+//SQLSessionStore stores sessions and the token denylist in the auth database
+type SQLSessionStore struct {
+	db *sql.DB
+}
+
+//NewSQLSessionStore returns a SessionStore backed by the given database
+func NewSQLSessionStore(db *sql.DB) *SQLSessionStore {
+	return &SQLSessionStore{db: db}
+}
+
+func (s *SQLSessionStore) CreateSession(session Session) error {
+	now := time.Now()
+	_, err := s.db.Exec("INSERT INTO sessions (sessionId, userId, clientId, device, ip, userAgent, createdAt, lastUsedAt, revokedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULL)",
+		session.ID, session.UserID, session.ClientID, session.Device, session.IP, session.UserAgent, now, now)
+	return err
+}
+
+func (s *SQLSessionStore) TouchSession(sessionID string, ip string) error {
+	_, err := s.db.Exec("UPDATE sessions SET ip = ?, lastUsedAt = ? WHERE sessionId = ?", ip, time.Now(), sessionID)
+	return err
+}
+
+func (s *SQLSessionStore) ListSessions(userID string) ([]Session, error) {
+	rows, err := s.db.Query("SELECT sessionId, userId, clientId, device, ip, userAgent, createdAt, lastUsedAt FROM sessions WHERE userId = ? AND revokedAt IS NULL AND lastUsedAt > ? ORDER BY lastUsedAt DESC",
+		userID, staleBefore())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(&session.ID, &session.UserID, &session.ClientID, &session.Device, &session.IP, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLSessionStore) RevokeSession(sessionID string) error {
+	_, err := s.db.Exec("UPDATE sessions SET revokedAt = ? WHERE sessionId = ? AND revokedAt IS NULL", time.Now(), sessionID)
+	return err
+}
+
+func (s *SQLSessionStore) RevokeAllSessions(userID string) error {
+	_, err := s.db.Exec("UPDATE sessions SET revokedAt = ? WHERE userId = ? AND revokedAt IS NULL", time.Now(), userID)
+	return err
+}
+
+func (s *SQLSessionStore) RevokeClientSessions(userID string, clientID string) error {
+	_, err := s.db.Exec("UPDATE sessions SET revokedAt = ? WHERE userId = ? AND clientId = ? AND revokedAt IS NULL", time.Now(), userID, clientID)
+	return err
+}
+
+func (s *SQLSessionStore) RevokeToken(jti string, expiresAt time.Time) error {
+	_, err := s.db.Exec("INSERT IGNORE INTO revoked_tokens (jti, expiresAt) VALUES (?, ?)", jti, expiresAt)
+	return err
+}
+
+func (s *SQLSessionStore) IsRevoked(claims AuthClaims) (bool, error) {
+	//Tokens minted before sessions existed can't be revoked, so they aren't trusted either
+	if claims.SessionID == "" {
+		return true, nil
+	}
+
+	var revokedAt sql.NullTime
+	err := s.db.QueryRow("SELECT revokedAt FROM sessions WHERE sessionId = ?", claims.SessionID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if revokedAt.Valid {
+		return true, nil
+	}
+
+	if claims.Id == "" {
+		return false, nil
+	}
+	var denied bool
+	err = s.db.QueryRow("SELECT EXISTS (SELECT * FROM revoked_tokens WHERE jti = ?)", claims.Id).Scan(&denied)
+	if err != nil {
+		return false, err
+	}
+	return denied, nil
+}
+
+func (s *SQLSessionStore) DeleteStaleSessions(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM sessions WHERE lastUsedAt < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLSessionStore) DeleteExpiredRevocations() (int64, error) {
+	res, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expiresAt < ?", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+//MemorySessionStore is an in-memory SessionStore for tests and local development
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+	denied   map[string]time.Time
+}
+
+type memorySession struct {
+	Session
+	revoked bool
+}
+
+//NewMemorySessionStore returns an empty MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]memorySession),
+		denied:   make(map[string]time.Time),
+	}
+}
+
+func (s *MemorySessionStore) CreateSession(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.CreatedAt = time.Now()
+	session.LastUsedAt = session.CreatedAt
+	s.sessions[session.ID] = memorySession{Session: session}
+	return nil
+}
+
+func (s *MemorySessionStore) TouchSession(sessionID string, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[sessionID]; ok {
+		session.IP = ip
+		session.LastUsedAt = time.Now()
+		s.sessions[sessionID] = session
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) ListSessions(userID string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := []Session{}
+	before := staleBefore()
+	for _, session := range s.sessions {
+		if session.UserID == userID && !session.revoked && session.LastUsedAt.After(before) {
+			sessions = append(sessions, session.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) RevokeSession(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[sessionID]; ok {
+		session.revoked = true
+		s.sessions[sessionID] = session
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) RevokeAllSessions(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			session.revoked = true
+			s.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) RevokeClientSessions(userID string, clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.UserID == userID && session.ClientID == clientID {
+			session.revoked = true
+			s.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) RevokeToken(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[jti] = expiresAt
+	return nil
+}
+
+func (s *MemorySessionStore) IsRevoked(claims AuthClaims) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[claims.SessionID]
+	if !ok || session.revoked {
+		return true, nil
+	}
+	_, denied := s.denied[claims.Id]
+	return denied, nil
+}
+
+func (s *MemorySessionStore) DeleteStaleSessions(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, session := range s.sessions {
+		if session.LastUsedAt.Before(before) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemorySessionStore) DeleteExpiredRevocations() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	now := time.Now()
+	for jti, expiresAt := range s.denied {
+		if expiresAt.Before(now) {
+			delete(s.denied, jti)
+			n++
+		}
+	}
+	return n, nil
+}
+
+//expireCookies asks the browser to drop the access and refresh tokens
+func expireCookies(w http.ResponseWriter) {
+	var expiresAt = time.Now().Add(-1 * time.Hour)
+	http.SetCookie(w, &http.Cookie{Name: "access_token", Value: "", Expires: expiresAt, Path: "/"})
+	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: "", Expires: expiresAt, Path: "/"})
+}
+
+//sessionInfo is a session as shown on the devices page
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	ClientID   string    `json:"clientId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Current    bool      `json:"current"`
+}
+
+//listSessions returns where the logged in user is logged in, marking the session of the request
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	sessions, err := sessionStore.ListSessions(claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, sessionInfo{
+			ID:         session.ID,
+			Device:     session.Device,
+			IP:         session.IP,
+			ClientID:   session.ClientID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			Current:    session.ID == claims.SessionID,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+//revokeSession signs one of the user's devices out. Its refresh tokens stop working and
+//posts and profiles reject its access tokens from their next request.
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	sessionID := mux.Vars(r)["id"]
+
+	//Only the user's own active sessions can be revoked, anything else looks like it doesn't exist
+	sessions, err := sessionStore.ListSessions(claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	found := false
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, errors.New("this session does not exist").Error(), http.StatusNotFound)
+		return
+	}
+
+	err = revokeTokenFamily(sessionID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking session").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if sessionID == claims.SessionID {
+		expireCookies(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+	err := sessionStore.RevokeAllSessions(claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error revoking sessions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	expireCookies(w)
+}
+
+//introspectionResponse is returned to the other services when they check a token
+type introspectionResponse struct {
+	Active bool `json:"active"`
+	*AuthClaims
+}
+
+//introspect lets posts and profiles check that a token they verified hasn't been revoked since,
+//and tells them who an API key belongs to
+func introspect(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding token from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if authn.IsAPIKey(request.Token) {
+		keyClaims, err := verifyAPIKey(request.Token)
+		if err == errAPIKeyInvalid {
+			json.NewEncoder(w).Encode(introspectionResponse{Active: false})
+			return
+		}
+		if err != nil {
+			http.Error(w, errors.New("error checking API key").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(introspectionResponse{Active: true, AuthClaims: keyClaims})
+		return
+	}
+
+	claims, err := getClaims(request.Token)
+	if err != nil || claims.Subject != "access" {
+		json.NewEncoder(w).Encode(introspectionResponse{Active: false})
+		return
+	}
+	revoked, err := sessionStore.IsRevoked(claims)
+	if err != nil {
+		http.Error(w, errors.New("error checking token revocation").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if revoked {
+		json.NewEncoder(w).Encode(introspectionResponse{Active: false})
+		return
+	}
+	json.NewEncoder(w).Encode(introspectionResponse{Active: true, AuthClaims: &claims})
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+//listedSessions reads the devices page with the cookies
+func listedSessions(t *testing.T, cookies []*http.Cookie) []sessionInfo {
+	t.Helper()
+	w := request(t, http.MethodGet, "/api/auth/sessions", nil, cookies...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sessions: got %d %s", w.Code, w.Body.String())
+	}
+	sessions := []sessionInfo{}
+	decode(t, w, &sessions)
+	return sessions
+}
+
+//sessionOf returns the session id the cookies are logged in with
+func sessionOf(t *testing.T, cookies []*http.Cookie) string {
+	t.Helper()
+	claims, err := getClaims(cookieNamed(t, cookies, "access_token").Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.SessionID
+}
+
+//signinAgain logs the user in from another device
+func signinAgain(t *testing.T, user testUser) []*http.Cookie {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("signin: got %d %s", w.Code, w.Body.String())
+	}
+	return w.Result().Cookies()
+}
+
+func TestListSessions(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "listsess")
+	laptop := sessionOf(t, user.Cookies)
+	phoneCookies := signinAgain(t, user)
+	phone := sessionOf(t, phoneCookies)
+
+	//The laptop was last used an hour ago, so the phone comes first
+	_, err := DB.Exec("UPDATE sessions SET lastUsedAt = ? WHERE sessionId = ?", time.Now().Add(-time.Hour), laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := listedSessions(t, user.Cookies)
+	if len(got) != 2 || got[0].ID != phone || got[1].ID != laptop {
+		t.Fatalf("got %+v, want the phone then the laptop", got)
+	}
+	if got[0].Current || !got[1].Current {
+		t.Errorf("got %+v, want only the laptop marked current", got)
+	}
+	if got = listedSessions(t, phoneCookies); !got[0].Current || got[1].Current {
+		t.Errorf("from the phone: got %+v, want only the phone marked current", got)
+	}
+
+	//Someone else's sessions aren't listed
+	if got = listedSessions(t, signupUser(t, "listother").Cookies); len(got) != 1 {
+		t.Errorf("another user: got %+v, want only their own session", got)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	sessionStores(t, func(t *testing.T, store SessionStore) {
+		resetLimits()
+		user := signupUser(t, "revokeone")
+		phoneCookies := signinAgain(t, user)
+		phone := sessionOf(t, phoneCookies)
+
+		stranger := signupUser(t, "stranger")
+		w := request(t, http.MethodDelete, "/api/auth/sessions/"+phone, nil, stranger.Cookies...)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("revoke by another user: got %d, want 404", w.Code)
+		}
+
+		//Signing the phone out leaves the laptop logged in
+		w = request(t, http.MethodDelete, "/api/auth/sessions/"+phone, nil, user.Cookies...)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("revoke: got %d %s", w.Code, w.Body.String())
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("revoking another device expired this one's cookies")
+		}
+		if w := request(t, http.MethodGet, "/api/auth/sessions", nil, cookieNamed(t, phoneCookies, "access_token")); w.Code != http.StatusUnauthorized {
+			t.Errorf("the phone's access token: got %d, want 401", w.Code)
+		}
+		if resp := refreshWith(t, cookieNamed(t, phoneCookies, "refresh_token")); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("the phone's refresh token: got %d, want 401", resp.StatusCode)
+		}
+		if got := listedSessions(t, user.Cookies); len(got) != 1 || !got[0].Current {
+			t.Errorf("got %+v, want only the laptop", got)
+		}
+		w = request(t, http.MethodDelete, "/api/auth/sessions/"+phone, nil, user.Cookies...)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("revoking it again: got %d, want 404", w.Code)
+		}
+	})
+}
+
+func TestRevokeCurrentSessionExpiresCookies(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "revokecur")
+	w := request(t, http.MethodDelete, "/api/auth/sessions/"+sessionOf(t, user.Cookies), nil, user.Cookies...)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: got %d %s", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"access_token", "refresh_token"} {
+		cookie := cookieNamed(t, w.Result().Cookies(), name)
+		if cookie.Value != "" || !cookie.Expires.Before(time.Now()) {
+			t.Errorf("%s: got %+v, want it expired", name, cookie)
+		}
+	}
+}
+
+func TestStaleSessions(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "stale")
+	stale := sessionOf(t, signinAgain(t, user))
+	_, err := DB.Exec("UPDATE sessions SET lastUsedAt = ? WHERE sessionId = ?", time.Now().Add(-DefaultRefreshJWTExpiry-time.Hour), stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listedSessions(t, user.Cookies); len(got) != 1 || got[0].ID == stale {
+		t.Fatalf("got %+v, want only the fresh session", got)
+	}
+	if _, err = sessionStore.DeleteStaleSessions(staleBefore()); err != nil {
+		t.Fatal(err)
+	}
+	var left int
+	err = DB.QueryRow("SELECT COUNT(*) FROM sessions WHERE userId = ?", user.UserID).Scan(&left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Errorf("%d sessions are left, want the fresh one", left)
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+	purposeChangeEmail   = "change_email"
+)
+
+var (
+	//verifyTokenTTL is how long a signup verification link stays valid
+	verifyTokenTTL = 24 * time.Hour
+	//resetTokenTTL is how long a password reset link stays valid
+	resetTokenTTL = 1 * time.Hour
+	//changeEmailTokenTTL is how long the confirmation link sent to a new address stays valid
+	changeEmailTokenTTL = 24 * time.Hour
+
+	errTokenInvalid = errors.New("this token is invalid, expired or has already been used")
+	//errTokenWrongUser is a token that could be redeemed, but not by this user
+	errTokenWrongUser = errors.New("this token was issued to another user")
+)
+
+//tokenService is the TokenService used by the handlers
+var tokenService *TokenService
+
+//TokenService issues and redeems the single-use tokens we send out by email. Only a
+//hash of each token is stored, so a leaked table can't be used to take over accounts.
+type TokenService struct {
+	db *sql.DB
+}
+
+//NewTokenService returns a TokenService storing tokens in the auth_tokens table
+func NewTokenService(db *sql.DB) *TokenService {
+	return &TokenService{db: db}
+}
+
+//Issue creates a new token for the user that can be consumed once for the given purpose
+func (s *TokenService) Issue(purpose string, userID string, ttl time.Duration) (string, error) {
+	return s.IssueWithData(purpose, userID, "", ttl)
+}
+
+//IssueWithData is Issue for tokens that carry a value, e.g. the address an email change goes to
+func (s *TokenService) IssueWithData(purpose string, userID string, data string, ttl time.Duration) (string, error) {
+	token := GetRandomBase62(tokenSize)
+	now := time.Now()
+	_, err := s.db.Exec("INSERT INTO auth_tokens (tokenHash, purpose, userId, data, createdAt, expiresAt, consumedAt) VALUES (?, ?, ?, ?, ?, ?, NULL)", hashToken(token), purpose, userID, data, now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//Consume redeems the token and returns the user it was issued to. It returns errTokenInvalid
+//if the token doesn't exist, was issued for another purpose, has expired or was already used.
+func (s *TokenService) Consume(purpose string, token string) (userID string, err error) {
+	userID, _, err = s.ConsumeWithData(purpose, token)
+	return userID, err
+}
+
+//ConsumeWithData is Consume for tokens issued with IssueWithData, it also returns their value
+func (s *TokenService) ConsumeWithData(purpose string, token string) (userID string, data string, err error) {
+	err = s.ConsumeIn(s.db, purpose, token)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = s.db.QueryRow("SELECT userId, data FROM auth_tokens WHERE tokenHash = ?", hashToken(token)).Scan(&userID, &data)
+	if err != nil {
+		return "", "", err
+	}
+	return userID, data, nil
+}
+
+//ConsumeIn marks the token used through db and returns errTokenInvalid like Consume. Pass
+//a transaction to use the token up together with the change it allows, after checking it
+//with Lookup.
+func (s *TokenService) ConsumeIn(db execer, purpose string, token string) error {
+	now := time.Now()
+	res, err := db.Exec("UPDATE auth_tokens SET consumedAt = ? WHERE tokenHash = ? AND purpose = ? AND consumedAt IS NULL AND expiresAt > ?", now, hashToken(token), purpose, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errTokenInvalid
+	}
+	return nil
+}
+
+//Lookup returns the user and value of a token that could be consumed, without consuming it.
+//Handlers use it to check a request before the token is used up. It returns errTokenInvalid
+//like Consume would.
+func (s *TokenService) Lookup(purpose string, token string) (userID string, data string, err error) {
+	err = s.db.QueryRow("SELECT userId, data FROM auth_tokens WHERE tokenHash = ? AND purpose = ? AND consumedAt IS NULL AND expiresAt > ?", hashToken(token), purpose, time.Now()).Scan(&userID, &data)
+	if err == sql.ErrNoRows {
+		return "", "", errTokenInvalid
+	}
+	return userID, data, err
+}
+
+//ConsumeFor is Consume for a token that has to have been issued to userID. A token issued
+//to someone else is left unused and errTokenWrongUser returned, so a mistyped username
+//doesn't burn the link.
+func (s *TokenService) ConsumeFor(purpose string, token string, userID string) error {
+	hash := hashToken(token)
+	now := time.Now()
+	res, err := s.db.Exec("UPDATE auth_tokens SET consumedAt = ? WHERE tokenHash = ? AND purpose = ? AND userId = ? AND consumedAt IS NULL AND expiresAt > ?", now, hash, purpose, userID, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var valid bool
+	err = s.db.QueryRow("SELECT EXISTS (SELECT * FROM auth_tokens WHERE tokenHash = ? AND purpose = ? AND consumedAt IS NULL AND expiresAt > ?)", hash, purpose, now).Scan(&valid)
+	if err != nil {
+		return err
+	}
+	if valid {
+		return errTokenWrongUser
+	}
+	return errTokenInvalid
+}
+
+//DeleteExpired removes every token past its expiry, used or not
+func (s *TokenService) DeleteExpired() (int64, error) {
+	res, err := s.db.Exec("DELETE FROM auth_tokens WHERE expiresAt < ?", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+//StartTokenJanitor deletes expired tokens, expired revocations, stale sessions and rate
+//limit attempts and lockouts that stopped counting every interval until the process exits
+func StartTokenJanitor(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			n, err := tokenService.DeleteExpired()
+			if err != nil {
+				log.Print("error deleting expired tokens: " + err.Error())
+			} else if n > 0 {
+				log.Printf("deleted %d expired tokens", n)
+			}
+
+			n, err = sessionStore.DeleteExpiredRevocations()
+			if err != nil {
+				log.Print("error deleting expired revocations: " + err.Error())
+			} else if n > 0 {
+				log.Printf("deleted %d expired revocations", n)
+			}
+
+			n, err = sessionStore.DeleteStaleSessions(staleBefore())
+			if err != nil {
+				log.Print("error deleting stale sessions: " + err.Error())
+			} else if n > 0 {
+				log.Printf("deleted %d stale sessions", n)
+			}
+
+			n, err = attemptStore.DeleteExpired(limitsExpiredBefore())
+			if err != nil {
+				log.Print("error deleting expired rate limit entries: " + err.Error())
+			} else if n > 0 {
+				log.Printf("deleted %d expired rate limit entries", n)
+			}
+		}
+	}()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//emailedToken is the token in the last email of the template sent to the user
+func emailedToken(t *testing.T, user testUser, template string) string {
+	t.Helper()
+	email, ok := testMailer.Last(user.Email)
+	if !ok || email.Template != template {
+		t.Fatalf("got %+v, want the %s email", email, template)
+	}
+	token, _ := email.Data["Token"].(string)
+	return token
+}
+
+func TestTokensAreSingleUse(t *testing.T) {
+	userID := uuid.New().String()
+	token, err := tokenService.Issue(purposeVerifyEmail, userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//A token only works for the purpose it was issued for, trying another doesn't use it up
+	if _, err = tokenService.Consume(purposeResetPassword, token); err != errTokenInvalid {
+		t.Errorf("another purpose: got %v, want errTokenInvalid", err)
+	}
+	got, err := tokenService.Consume(purposeVerifyEmail, token)
+	if err != nil || got != userID {
+		t.Fatalf("got %q, %v, want the user", got, err)
+	}
+	if _, err = tokenService.Consume(purposeVerifyEmail, token); err != errTokenInvalid {
+		t.Errorf("second use: got %v, want errTokenInvalid", err)
+	}
+	if _, err = tokenService.Consume(purposeVerifyEmail, "made up"); err != errTokenInvalid {
+		t.Errorf("a made up token: got %v, want errTokenInvalid", err)
+	}
+}
+
+func TestTokensExpire(t *testing.T) {
+	userID := uuid.New().String()
+	expired, err := tokenService.Issue(purposeResetPassword, userID, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tokenService.Consume(purposeResetPassword, expired); err != errTokenInvalid {
+		t.Errorf("expired token: got %v, want errTokenInvalid", err)
+	}
+	if _, _, err = tokenService.Lookup(purposeResetPassword, expired); err != errTokenInvalid {
+		t.Errorf("looking up the expired token: got %v, want errTokenInvalid", err)
+	}
+
+	//The janitor deletes expired tokens and leaves the others
+	valid, err := tokenService.Issue(purposeResetPassword, userID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := tokenService.DeleteExpired()
+	if err != nil || n < 1 {
+		t.Errorf("got %d deleted (%v), want the expired token", n, err)
+	}
+	var left int
+	err = DB.QueryRow("SELECT COUNT(*) FROM auth_tokens WHERE userId = ?", userID).Scan(&left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Errorf("got %d tokens left, want 1", left)
+	}
+	if _, err = tokenService.Consume(purposeResetPassword, valid); err != nil {
+		t.Errorf("the valid token: got %v", err)
+	}
+}
+
+func TestVerifyLinkIsSingleUse(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "verifyonce")
+	token := emailedToken(t, user, "user-signup.html")
+
+	if w := request(t, http.MethodPost, "/api/auth/verify?token="+token, nil); w.Code != http.StatusOK {
+		t.Fatalf("verify: got %d %s", w.Code, w.Body.String())
+	}
+	if w := request(t, http.MethodPost, "/api/auth/verify?token="+token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("verify again: got %d, want 400", w.Code)
+	}
+}
+
+func TestResetLinkIsSingleUseAndExpires(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "resetonce")
+	request(t, http.MethodPost, "/api/auth/sendreset", Credentials{Username: user.Username, Email: user.Email, Password: "unused"})
+	token := emailedToken(t, user, "password-reset.html")
+
+	//Someone else's username leaves the link usable
+	other := signupUser(t, "resetother")
+	w := request(t, http.MethodPost, "/api/auth/resetpw?token="+token, Credentials{Username: other.Username, Email: other.Email, Password: "another new passphrase"})
+	if w.Code != http.StatusConflict {
+		t.Errorf("another user: got %d, want 409", w.Code)
+	}
+
+	reset := Credentials{Username: user.Username, Email: user.Email, Password: "a brand new passphrase"}
+	if w := request(t, http.MethodPost, "/api/auth/resetpw?token="+token, reset); w.Code != http.StatusOK {
+		t.Fatalf("reset: got %d %s", w.Code, w.Body.String())
+	}
+	reset.Password = "yet another passphrase"
+	if w := request(t, http.MethodPost, "/api/auth/resetpw?token="+token, reset); w.Code != http.StatusBadRequest {
+		t.Errorf("reset again: got %d, want 400", w.Code)
+	}
+
+	//A link past its expiry is refused like a used one
+	resetLimits()
+	request(t, http.MethodPost, "/api/auth/sendreset", Credentials{Username: user.Username, Email: user.Email, Password: "unused"})
+	token = emailedToken(t, user, "password-reset.html")
+	_, err := DB.Exec("UPDATE auth_tokens SET expiresAt = ? WHERE tokenHash = ?", time.Now().Add(-time.Minute), hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := request(t, http.MethodPost, "/api/auth/resetpw?token="+token, reset); w.Code != http.StatusBadRequest {
+		t.Errorf("expired link: got %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,410 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	totpIssuer = "BearChat"
+	totpDigits = 6
+	totpPeriod = 30
+	//totpSkew is how many periods either side of now we accept, for clocks that drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	//purposeMFAPending tokens are the ids of mfa_pending tokens, so each can be used once
+	purposeMFAPending = "mfa_pending"
+)
+
+//mfaPendingExpiry is how long the user has to enter their code after their password
+var mfaPendingExpiry = 5 * time.Minute
+
+var errMFAPendingInvalid = errors.New("the sign in has expired, enter your password again")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//hotp computes the RFC 4226 one-time password for the counter
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+//checkTOTP looks for the time step the code was generated for, newer than lastStep so
+//that a code can't be replayed. It returns the step it matched.
+func checkTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+//finishSignin logs the user in once their password (or another first factor) checked out.
+//Users who enrolled in TOTP get a short-lived mfa_pending token instead of the cookies,
+//which they trade for the cookies along with a code at /api/auth/signin/mfa. pending
+//reports which of the two happened.
+func finishSignin(w http.ResponseWriter, r *http.Request, userID string) (pending bool, err error) {
+	var locked bool
+	err = DB.QueryRow("SELECT locked FROM users WHERE userId = ?", userID).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	if locked {
+		return false, errAccountLocked
+	}
+
+	var enrolled bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT * FROM mfa_totp WHERE userId = ? AND confirmed = TRUE)", userID).Scan(&enrolled)
+	if err != nil {
+		return false, err
+	}
+	if !enrolled {
+		return false, issueTokens(w, r, userID, "")
+	}
+
+	//The id is also a single-use token, so a code can't be paired with the same password twice
+	mfaID, err := tokenService.Issue(purposeMFAPending, userID, mfaPendingExpiry)
+	if err != nil {
+		return false, err
+	}
+	mfaToken, err := setClaims(AuthClaims{
+		UserID: userID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        mfaID,
+			Subject:   "mfa_pending",
+			ExpiresAt: time.Now().Add(mfaPendingExpiry).Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	return true, json.NewEncoder(w).Encode(map[string]interface{}{"mfaRequired": true, "mfaToken": mfaToken})
+}
+
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	var username string
+	err := DB.QueryRow("SELECT username FROM users WHERE userId = ?", claims.UserID).Scan(&username)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	var confirmed bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT * FROM mfa_totp WHERE userId = ? AND confirmed = TRUE)", claims.UserID).Scan(&confirmed)
+	if err != nil {
+		http.Error(w, errors.New("error checking enrollment").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if confirmed {
+		http.Error(w, errors.New("two-factor authentication is already enabled").Error(), http.StatusConflict)
+		return
+	}
+
+	//Generate a 160 bit secret, the size RFC 4226 recommends for HMAC-SHA1
+	key := make([]byte, 20)
+	_, err = rand.Read(key)
+	if err != nil {
+		http.Error(w, errors.New("error generating secret").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	//Starting over replaces a secret that was never confirmed
+	_, err = DB.Exec("REPLACE INTO mfa_totp (userId, secret, confirmed, lastUsedStep) VALUES (?, ?, FALSE, 0)", claims.UserID, secret)
+	if err != nil {
+		http.Error(w, errors.New("error storing secret").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: params.Encode(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret, "uri": uri.String()})
+}
+
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding code from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	var secret string
+	var confirmed bool
+	err = DB.QueryRow("SELECT secret, confirmed FROM mfa_totp WHERE userId = ?", claims.UserID).Scan(&secret, &confirmed)
+	if err == sql.ErrNoRows {
+		http.Error(w, errors.New("two-factor enrollment has not been started").Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error retrieving secret").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if confirmed {
+		http.Error(w, errors.New("two-factor authentication is already enabled").Error(), http.StatusConflict)
+		return
+	}
+
+	step, ok := checkTOTP(secret, request.Code, 0, time.Now())
+	if !ok {
+		http.Error(w, errors.New("the code is not valid").Error(), http.StatusBadRequest)
+		return
+	}
+
+	//Recovery codes are shown once, only their hashes are kept
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := strings.ToLower(GetRandomBase62(10))
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, errors.New("error enabling two-factor authentication").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE mfa_totp SET confirmed = TRUE, lastUsedStep = ? WHERE userId = ?", step, claims.UserID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM mfa_recovery_codes WHERE userId = ?", claims.UserID)
+	}
+	for i := 0; err == nil && i < len(codes); i++ {
+		_, err = tx.Exec("INSERT INTO mfa_recovery_codes (userId, codeHash, usedAt) VALUES (?, ?, NULL)", claims.UserID, hashRecoveryCode(codes[i]))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, errors.New("error enabling two-factor authentication").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+//signinMFA trades an mfa_pending token and a TOTP or recovery code for the real cookies
+func signinMFA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var request struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding code from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	claims, err := getClaims(request.MFAToken)
+	if err == nil && claims.Subject == "mfa_pending" {
+		_, _, err = tokenService.Lookup(purposeMFAPending, claims.Id)
+	} else {
+		err = errTokenInvalid
+	}
+	if err == errTokenInvalid {
+		http.Error(w, errMFAPendingInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error checking the sign in").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	userID := claims.UserID
+
+	//Six digits don't take long to guess, so codes are throttled like passwords
+	limits := []limitKey{
+		{ipLimiter, "mfa:ip:" + clientIP(r)},
+		{accountLimiter, "mfa:user:" + userID},
+	}
+	if !checkLimits(w, limits...) {
+		recordEvent(r, eventSignin, userID, outcomeBlocked)
+		return
+	}
+
+	var ok bool
+	if request.RecoveryCode != "" {
+		ok, err = useRecoveryCode(userID, request.RecoveryCode)
+	} else {
+		ok, err = useTOTPCode(userID, request.Code)
+	}
+	if err != nil {
+		http.Error(w, errors.New("error checking code").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if !ok {
+		recordAttempts(limits...)
+		recordEvent(r, eventSignin, userID, outcomeFailure)
+		http.Error(w, errors.New("the code is not valid").Error(), http.StatusUnauthorized)
+		return
+	}
+	err = accountLimiter.Reset("mfa:user:" + userID)
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	//Use up the mfa_pending token, a request racing this one with another code gets nothing
+	err = tokenService.ConsumeFor(purposeMFAPending, claims.Id, userID)
+	if err == errTokenInvalid || err == errTokenWrongUser {
+		http.Error(w, errMFAPendingInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error checking the sign in").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	err = issueTokens(w, r, userID, "")
+	if err == errAccountLocked {
+		recordEvent(r, eventSignin, userID, outcomeBlocked)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	recordEvent(r, eventSignin, userID, outcomeSuccess)
+}
+
+//useTOTPCode checks the code and remembers its time step so it can't be used twice
+func useTOTPCode(userID string, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := DB.QueryRow("SELECT secret, lastUsedStep FROM mfa_totp WHERE userId = ? AND confirmed = TRUE", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := checkTOTP(secret, code, lastStep, time.Now())
+	if !ok {
+		return false, nil
+	}
+	res, err := DB.Exec("UPDATE mfa_totp SET lastUsedStep = ? WHERE userId = ? AND lastUsedStep < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+//useRecoveryCode burns one of the user's recovery codes
+func useRecoveryCode(userID string, code string) (bool, error) {
+	res, err := DB.Exec("UPDATE mfa_recovery_codes SET usedAt = ? WHERE userId = ? AND codeHash = ? AND usedAt IS NULL", time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+//hashRecoveryCode hashes the code the way it was shown, ignoring case, dashes and spaces
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//enrollTestTOTP turns on TOTP for the user and returns the secret and recovery codes
+func enrollTestTOTP(t *testing.T, user testUser) (string, []string) {
+	t.Helper()
+	//The tests count on the time step not changing under them, so wait out the end of one
+	if left := totpPeriod - time.Now().Unix()%totpPeriod; left < 5 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+
+	w := request(t, http.MethodPost, "/api/auth/mfa/totp/enroll", nil, user.Cookies...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: got %d %s", w.Code, w.Body.String())
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	decode(t, w, &enrollment)
+
+	//Confirming uses the step before now, so the current one is left for signing in
+	w = request(t, http.MethodPost, "/api/auth/mfa/totp/confirm", map[string]string{"code": totpCode(t, enrollment.Secret, -1)}, user.Cookies...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: got %d %s", w.Code, w.Body.String())
+	}
+	var confirmation struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	decode(t, w, &confirmation)
+	return enrollment.Secret, confirmation.RecoveryCodes
+}
+
+//totpCode is the code for the time step offset steps away from now
+func totpCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(key, uint64(time.Now().Unix()/totpPeriod+offset))
+}
+
+//passwordStep signs the user in with their password and returns the mfa_pending token
+func passwordStep(t *testing.T, user testUser) string {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/signin", Credentials{Username: user.Username, Password: user.Password})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("signin: got %d %s, want 202", w.Code, w.Body.String())
+	}
+	var pending struct {
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+	}
+	decode(t, w, &pending)
+	if !pending.MFARequired || pending.MFAToken == "" || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("got %s with %d cookies, want only an mfa token", w.Body.String(), len(w.Result().Cookies()))
+	}
+	return pending.MFAToken
+}
+
+//mfaStep sends the second step of a signin and returns the status code
+func mfaStep(t *testing.T, mfaToken string, code string, recoveryCode string) int {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/signin/mfa", map[string]string{"mfaToken": mfaToken, "code": code, "recoveryCode": recoveryCode})
+	if w.Code == http.StatusOK && len(w.Result().Cookies()) == 0 {
+		t.Fatal("signed in without cookies")
+	}
+	return w.Code
+}
+
+func TestTOTPCodesCantBeReplayed(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "totp")
+	secret, _ := enrollTestTOTP(t, user)
+
+	//The code confirming enrollment is already used
+	if code := mfaStep(t, passwordStep(t, user), totpCode(t, secret, -1), ""); code != http.StatusUnauthorized {
+		t.Errorf("the enrollment code: got %d, want 401", code)
+	}
+
+	//A wrong code doesn't use up the mfa token
+	mfaToken := passwordStep(t, user)
+	if code := mfaStep(t, mfaToken, "000000", ""); code != http.StatusUnauthorized && totpCode(t, secret, 0) != "000000" {
+		t.Errorf("a wrong code: got %d, want 401", code)
+	}
+	if code := mfaStep(t, mfaToken, totpCode(t, secret, 0), ""); code != http.StatusOK {
+		t.Fatalf("the current code: got %d", code)
+	}
+	if code := mfaStep(t, passwordStep(t, user), totpCode(t, secret, 0), ""); code != http.StatusUnauthorized {
+		t.Errorf("the same code again: got %d, want 401", code)
+	}
+	if code := mfaStep(t, passwordStep(t, user), totpCode(t, secret, 1), ""); code != http.StatusOK {
+		t.Errorf("the next code: got %d", code)
+	}
+}
+
+func TestMFATokenIsSingleUse(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "mfaonce")
+	secret, recoveryCodes := enrollTestTOTP(t, user)
+
+	mfaToken := passwordStep(t, user)
+	if code := mfaStep(t, mfaToken, totpCode(t, secret, 0), ""); code != http.StatusOK {
+		t.Fatalf("first use: got %d", code)
+	}
+
+	//Another valid factor doesn't make the token good again, and isn't burned trying
+	if code := mfaStep(t, mfaToken, "", recoveryCodes[0]); code != http.StatusUnauthorized {
+		t.Errorf("second use: got %d, want 401", code)
+	}
+	if code := mfaStep(t, passwordStep(t, user), "", recoveryCodes[0]); code != http.StatusOK {
+		t.Errorf("the recovery code after the replay: got %d", code)
+	}
+
+	//So is a token that isn't an mfa_pending token
+	if code := mfaStep(t, "not a token", totpCode(t, secret, 1), ""); code != http.StatusUnauthorized {
+		t.Errorf("a made up token: got %d, want 401", code)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	resetLimits()
+	user := signupUser(t, "recovery")
+	_, recoveryCodes := enrollTestTOTP(t, user)
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+	}
+
+	//Codes are matched ignoring case, dashes and spaces
+	typed := strings.ToUpper(strings.Replace(recoveryCodes[0], "-", " ", 1))
+	if code := mfaStep(t, passwordStep(t, user), "", typed); code != http.StatusOK {
+		t.Fatalf("recovery code %q: got %d", typed, code)
+	}
+	if code := mfaStep(t, passwordStep(t, user), "", recoveryCodes[0]); code != http.StatusUnauthorized {
+		t.Errorf("the used recovery code: got %d, want 401", code)
+	}
+	if code := mfaStep(t, passwordStep(t, user), "", recoveryCodes[1]); code != http.StatusOK {
+		t.Errorf("another recovery code: got %d", code)
+	}
+
+	//Someone else's code is no good
+	other := signupUser(t, "recovery")
+	_, otherCodes := enrollTestTOTP(t, other)
+	if code := mfaStep(t, passwordStep(t, user), "", otherCodes[0]); code != http.StatusUnauthorized {
+		t.Errorf("another user's recovery code: got %d, want 401", code)
+	}
+}
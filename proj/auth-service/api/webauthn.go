@@ -0,0 +1,687 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/gorilla/mux"
+)
+
+const (
+	purposeWebAuthnRegister = "webauthn_register"
+	purposeWebAuthnLogin    = "webauthn_login"
+
+	//Authenticator data flags
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+
+	//COSE algorithms we accept, ES256 and RS256
+	coseES256 = -7
+	coseRS256 = -257
+)
+
+var (
+	//webauthnRPID is the domain passkeys are bound to, WEBAUTHN_RP_ID overrides it
+	webauthnRPID   = "localhost"
+	webauthnRPName = "BearChat"
+	//webauthnOrigin is the page the ceremonies run on, WEBAUTHN_ORIGIN overrides it
+	webauthnOrigin = "http://localhost:3000"
+	//webauthnTimeout is how long a challenge can be answered
+	webauthnTimeout = 5 * time.Minute
+
+	errPasskeyInvalid = errors.New("passkey could not be verified")
+)
+
+//Passkey describes a registered credential, without its key
+type Passkey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+//credentialDescriptor names a credential in the options sent to the browser
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+//publicKeyCredential is what navigator.credentials.create or get returned, with every
+//binary field base64url encoded by the frontend
+type publicKeyCredential struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+//collectedClientData is the clientDataJSON the browser signs over
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+//authenticatorData is the parsed authenticator data of either ceremony
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	//Only set during registration
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+//decodeBase64URL accepts base64url with or without padding, browsers differ
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+//checkClientData checks the ceremony type and origin and returns the challenge, which is the
+//single-use token issued when the ceremony began
+func checkClientData(raw []byte, ceremony string) (string, error) {
+	var clientData collectedClientData
+	err := json.Unmarshal(raw, &clientData)
+	if err != nil {
+		return "", err
+	}
+	if clientData.Type != ceremony {
+		return "", fmt.Errorf("client data is for %q", clientData.Type)
+	}
+	if clientData.Origin != webauthnOrigin {
+		return "", fmt.Errorf("client data comes from %q", clientData.Origin)
+	}
+	challenge, err := decodeBase64URL(clientData.Challenge)
+	if err != nil {
+		return "", err
+	}
+	return string(challenge), nil
+}
+
+//parseAuthenticatorData parses the authenticator data and checks it is for us and that the
+//user was present
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	authData := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(webauthnRPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return nil, errors.New("authenticator data is for another relying party")
+	}
+	if authData.Flags&flagUserPresent == 0 {
+		return nil, errors.New("user was not present")
+	}
+	if authData.Flags&flagAttestedCredData == 0 {
+		return authData, nil
+	}
+
+	//The attested credential: a 16 byte AAGUID, the id length and id, then the COSE key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, errors.New("credential id is truncated")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+	authData.PublicKey = rest[:len(rest)-len(after)]
+	return authData, nil
+}
+
+//parseCOSEKey turns a COSE_Key into a public key, returning its COSE algorithm
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("COSE key is not a map")
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("ES256 key is not on P-256")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errors.New("ES256 key is not on P-256")
+		}
+		return pub, alg, nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) < 1 || len(e) > 4 {
+			return nil, 0, errors.New("RS256 key is malformed or too small")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported COSE key type %d with algorithm %d", kty, alg)
+}
+
+//verifyAssertion checks the signature over the authenticator data and the client data hash
+func verifyAssertion(publicKey []byte, authData []byte, clientDataJSON []byte, signature []byte) error {
+	pub, _, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return errors.New("ES256 signature does not match")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+	}
+	return errors.New("unsupported key")
+}
+
+//userPasskeys returns the ids of the user's credentials in descriptor form
+func userPasskeys(userID string) ([]credentialDescriptor, error) {
+	rows, err := DB.Query("SELECT credentialId FROM webauthn_credentials WHERE userId = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	descriptors := []credentialDescriptor{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, credentialDescriptor{Type: "public-key", ID: id})
+	}
+	return descriptors, rows.Err()
+}
+
+//beginPasskeyRegistration returns the options for navigator.credentials.create
+func beginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	var username string
+	err := DB.QueryRow("SELECT username FROM users WHERE userId = ?", claims.UserID).Scan(&username)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	//Don't let the same authenticator register twice
+	existing, err := userPasskeys(claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving passkeys").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	challenge, err := tokenService.Issue(purposeWebAuthnRegister, claims.UserID, webauthnTimeout)
+	if err != nil {
+		http.Error(w, errors.New("error starting registration").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge": base64.RawURLEncoding.EncodeToString([]byte(challenge)),
+		"rp":        map[string]string{"id": webauthnRPID, "name": webauthnRPName},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(claims.UserID)),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"timeout":            webauthnTimeout.Milliseconds(),
+		"excludeCredentials": existing,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+	}})
+}
+
+//finishPasskeyRegistration checks the new credential and stores its public key
+func finishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	credential := publicKeyCredential{}
+	err := json.NewDecoder(r.Body).Decode(&credential)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding credential from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	credential.Name = strings.TrimSpace(credential.Name)
+	if credential.Name == "" {
+		credential.Name = "Passkey"
+	}
+	if len(credential.Name) > 64 {
+		http.Error(w, "400", http.StatusBadRequest)
+		return
+	}
+
+	clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+	if err != nil {
+		http.Error(w, errPasskeyInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	challenge, err := checkClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		http.Error(w, errPasskeyInvalid.Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	userID, err := tokenService.Consume(purposeWebAuthnRegister, challenge)
+	if err == errTokenInvalid || (err == nil && userID != claims.UserID) {
+		http.Error(w, errors.New("registration expired, please start again").Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming challenge").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	//We ask for no attestation, so only the authenticator data inside is looked at
+	attestationObject, err := decodeBase64URL(credential.Response.AttestationObject)
+	if err != nil {
+		http.Error(w, errPasskeyInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	decoded, _, err := decodeCBOR(attestationObject)
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if err != nil || !ok {
+		http.Error(w, errPasskeyInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err == nil && authData.CredentialID == nil {
+		err = errors.New("attestation has no credential")
+	}
+	if err == nil && base64.RawURLEncoding.EncodeToString(authData.CredentialID) != strings.TrimRight(credential.ID, "=") {
+		err = errors.New("credential id does not match the attestation")
+	}
+	if err == nil {
+		_, _, err = parseCOSEKey(authData.PublicKey)
+	}
+	if err != nil {
+		http.Error(w, errPasskeyInvalid.Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	passkey := Passkey{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		Name:      credential.Name,
+		CreatedAt: time.Now(),
+	}
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS (SELECT * FROM webauthn_credentials WHERE credentialId = ?)", passkey.ID).Scan(&exists)
+	if err != nil {
+		http.Error(w, errors.New("error checking if passkey exists").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if exists {
+		http.Error(w, errors.New("this passkey is already registered").Error(), http.StatusConflict)
+		return
+	}
+	_, err = DB.Exec("INSERT INTO webauthn_credentials (credentialId, userId, name, publicKey, signCount, createdAt, lastUsedAt) VALUES (?, ?, ?, ?, ?, ?, NULL)",
+		passkey.ID, claims.UserID, passkey.Name, authData.PublicKey, authData.SignCount, passkey.CreatedAt)
+	if err != nil {
+		http.Error(w, errors.New("error saving passkey").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+//listPasskeys returns the passkeys of the logged in user
+func listPasskeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	rows, err := DB.Query("SELECT credentialId, name, createdAt, lastUsedAt FROM webauthn_credentials WHERE userId = ? ORDER BY createdAt", claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving passkeys").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var passkey Passkey
+		var lastUsedAt sql.NullTime
+		err = rows.Scan(&passkey.ID, &passkey.Name, &passkey.CreatedAt, &lastUsedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving passkeys").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if lastUsedAt.Valid {
+			passkey.LastUsedAt = &lastUsedAt.Time
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+//deletePasskey removes one of the logged in user's passkeys
+func deletePasskey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	claims, _ := authn.FromContext(r.Context())
+
+	res, err := DB.Exec("DELETE FROM webauthn_credentials WHERE credentialId = ? AND userId = ?", mux.Vars(r)["credentialId"], claims.UserID)
+	if err != nil {
+		http.Error(w, errors.New("error deleting passkey").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, errors.New("error deleting passkey").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if n == 0 {
+		http.Error(w, errors.New("this passkey does not exist").Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//beginPasskeyLogin returns the options for navigator.credentials.get. Without a username
+//the browser offers every passkey it has for us.
+func beginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	var request struct {
+		Username string `json:"username"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding username from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	//An unknown username gets an empty list rather than an error, so this can't be used to find accounts
+	var userID string
+	allowed := []credentialDescriptor{}
+	if request.Username != "" {
+		err = DB.QueryRow("SELECT userId FROM users WHERE username = ?", request.Username).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, errors.New("error retrieving user").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if userID != "" {
+			allowed, err = userPasskeys(userID)
+			if err != nil {
+				http.Error(w, errors.New("error retrieving passkeys").Error(), http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+	}
+
+	challenge, err := tokenService.Issue(purposeWebAuthnLogin, userID, webauthnTimeout)
+	if err != nil {
+		http.Error(w, errors.New("error starting login").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge":        base64.RawURLEncoding.EncodeToString([]byte(challenge)),
+		"rpId":             webauthnRPID,
+		"timeout":          webauthnTimeout.Milliseconds(),
+		"allowCredentials": allowed,
+		"userVerification": "preferred",
+	}})
+}
+
+//finishPasskeyLogin checks the assertion and logs the user in like signin does. A passkey
+//that verified the user (PIN or biometrics) counts as both factors and skips TOTP.
+func finishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	credential := publicKeyCredential{}
+	err := json.NewDecoder(r.Body).Decode(&credential)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding credential from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	limits := []limitKey{{ipLimiter, "webauthn:ip:" + clientIP(r)}}
+	if !checkLimits(w, limits...) {
+		recordEvent(r, eventSignin, "", outcomeBlocked)
+		return
+	}
+	//userID is set once the passkey is found, failures before that aren't tied to a user
+	var userID string
+	fail := func(err error) {
+		recordAttempts(limits...)
+		recordEvent(r, eventSignin, userID, outcomeFailure)
+		http.Error(w, errPasskeyInvalid.Error(), http.StatusUnauthorized)
+		if err != nil {
+			log.Print(err.Error())
+		}
+	}
+
+	clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+	if err != nil {
+		fail(err)
+		return
+	}
+	challenge, err := checkClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		fail(err)
+		return
+	}
+	expectedUserID, err := tokenService.Consume(purposeWebAuthnLogin, challenge)
+	if err == errTokenInvalid {
+		fail(nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error redeeming challenge").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	credentialID := strings.TrimRight(credential.ID, "=")
+	var publicKey []byte
+	var signCount uint32
+	err = DB.QueryRow("SELECT userId, publicKey, signCount FROM webauthn_credentials WHERE credentialId = ?", credentialID).Scan(&userID, &publicKey, &signCount)
+	if err == sql.ErrNoRows {
+		fail(nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error retrieving passkey").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	//The challenge may have been asked for a particular user, and the authenticator may say whose key it is
+	if expectedUserID != "" && expectedUserID != userID {
+		fail(errors.New("passkey belongs to another user"))
+		return
+	}
+	if credential.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(credential.Response.UserHandle)
+		if err != nil || string(userHandle) != userID {
+			fail(errors.New("user handle does not match the passkey"))
+			return
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(credential.Response.AuthenticatorData)
+	if err != nil {
+		fail(err)
+		return
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		fail(err)
+		return
+	}
+	signature, err := decodeBase64URL(credential.Response.Signature)
+	if err != nil {
+		fail(err)
+		return
+	}
+	err = verifyAssertion(publicKey, rawAuthData, clientDataJSON, signature)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	//A counter that doesn't move forward means the key may have been cloned. Authenticators
+	//without a counter always send 0. The update only goes through if nobody raced us.
+	res, err := DB.Exec("UPDATE webauthn_credentials SET signCount = ?, lastUsedAt = ? WHERE credentialId = ? AND (signCount < ? OR (signCount = 0 AND ? = 0))",
+		authData.SignCount, time.Now(), credentialID, authData.SignCount, authData.SignCount)
+	if err != nil {
+		http.Error(w, errors.New("error updating passkey").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, errors.New("error updating passkey").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if n == 0 {
+		fail(fmt.Errorf("sign counter of passkey %s went from %d to %d, it may be cloned", credentialID, signCount, authData.SignCount))
+		return
+	}
+
+	pending := false
+	if authData.Flags&flagUserVerified != 0 {
+		err = issueTokens(w, r, userID, "")
+	} else {
+		pending, err = finishSignin(w, r, userID)
+	}
+	if err == errAccountLocked {
+		recordEvent(r, eventSignin, userID, outcomeBlocked)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error generating tokens").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if pending {
+		recordEvent(r, eventSignin, userID, outcomeMFARequired)
+		return
+	}
+	recordEvent(r, eventSignin, userID, outcomeSuccess)
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+//webauthnOptions is the part of the ceremony options the authenticator needs
+type webauthnOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+//softAuthenticator is a software authenticator holding one P-256 credential. origin and
+//rpID are what it reports, set them to something else to play a phishing page.
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	signCount  uint32
+	origin     string
+	rpID       string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 32)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, origin: webauthnOrigin, rpID: webauthnRPID}
+}
+
+//create answers a registration challenge with a "none" attestation
+func (a *softAuthenticator) create(challenge string) map[string]interface{} {
+	clientData := a.clientData("webauthn.create", challenge)
+
+	var authData bytes.Buffer
+	authData.Write(a.authDataHeader(flagUserPresent | flagUserVerified | flagAttestedCredData))
+	authData.Write(make([]byte, 16))
+	binary.Write(&authData, binary.BigEndian, uint16(len(a.id)))
+	authData.Write(a.id)
+	authData.Write(encodeCBORMap(map[int64]interface{}{
+		1:  int64(2),
+		3:  int64(coseES256),
+		-1: int64(1),
+		-2: pad32(a.key.X.Bytes()),
+		-3: pad32(a.key.Y.Bytes()),
+	}))
+
+	attestation := encodeCBORTextMap(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[int64]interface{}{},
+		"authData": authData.Bytes(),
+	})
+	return map[string]interface{}{
+		"id":   base64.RawURLEncoding.EncodeToString(a.id),
+		"type": "public-key",
+		"name": "test key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+//get answers a login challenge by signing the authenticator data and client data hash
+func (a *softAuthenticator) get(challenge string) map[string]interface{} {
+	clientData := a.clientData("webauthn.get", challenge)
+	a.signCount++
+	authData := a.authDataHeader(flagUserPresent | flagUserVerified)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return map[string]interface{}{
+		"id":   base64.RawURLEncoding.EncodeToString(a.id),
+		"type": "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+//authDataHeader is the RP id hash, the flags and the counter
+func (a *softAuthenticator) authDataHeader(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	header := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[33:], a.signCount)
+	return header
+}
+
+//register runs the registration ceremony for the logged in user
+func (a *softAuthenticator) register(t *testing.T, user testUser) *http.Response {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/webauthn/register/begin", map[string]string{}, user.Cookies...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register begin: got %d %s", w.Code, w.Body.String())
+	}
+	var options webauthnOptions
+	err := json.NewDecoder(w.Body).Decode(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle, err = base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request(t, http.MethodPost, "/api/auth/webauthn/register/finish", a.create(options.PublicKey.Challenge), user.Cookies...).Result()
+}
+
+//login runs the login ceremony without any cookies, the passkey alone has to get in
+func (a *softAuthenticator) login(t *testing.T) *http.Response {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/auth/webauthn/login/begin", map[string]string{})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login begin: got %d %s", w.Code, w.Body.String())
+	}
+	var options webauthnOptions
+	err := json.NewDecoder(w.Body).Decode(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request(t, http.MethodPost, "/api/auth/webauthn/login/finish", a.get(options.PublicKey.Challenge)).Result()
+}
+
+//registeredAuthenticator signs up a user and registers a passkey for them
+func registeredAuthenticator(t *testing.T, name string) (testUser, *softAuthenticator) {
+	t.Helper()
+	resetLimits()
+	user := signupUser(t, name)
+	a := newSoftAuthenticator(t)
+	if resp := a.register(t, user); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register finish: got %d", resp.StatusCode)
+	}
+	return user, a
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	user, a := registeredAuthenticator(t, "passkey")
+	if string(a.userHandle) != user.UserID {
+		t.Errorf("got user handle %q, want the user id", a.userHandle)
+	}
+
+	w := request(t, http.MethodGet, "/api/auth/webauthn/credentials", nil, user.Cookies...)
+	var passkeys []Passkey
+	json.NewDecoder(w.Body).Decode(&passkeys)
+	if len(passkeys) != 1 {
+		t.Fatalf("got %d passkeys, want 1", len(passkeys))
+	}
+
+	//Registering the same credential twice is refused
+	if resp := a.register(t, user); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second registration: got %d, want 409", resp.StatusCode)
+	}
+
+	resp := a.login(t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got %d", resp.StatusCode)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "access_token" {
+			claims, err := getClaims(cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.UserID != user.UserID {
+				t.Errorf("logged in as %s, want %s", claims.UserID, user.UserID)
+			}
+			return
+		}
+	}
+	t.Error("login set no access token")
+}
+
+func TestPasskeySignCountGoingBackwards(t *testing.T) {
+	_, a := registeredAuthenticator(t, "pkcount")
+	if resp := a.login(t); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got %d", resp.StatusCode)
+	}
+
+	//A clone of the key still has the old counter
+	a.signCount = 0
+	if resp := a.login(t); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with a repeated counter: got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestPasskeyWrongOriginOrRPID(t *testing.T) {
+	for name, set := range map[string]func(a *softAuthenticator){
+		"origin": func(a *softAuthenticator) { a.origin = "https://bearchat.evil.example.com" },
+		"rp id":  func(a *softAuthenticator) { a.rpID = "evil.example.com" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			resetLimits()
+			user := signupUser(t, "pkphish")
+			a := newSoftAuthenticator(t)
+			set(a)
+			if resp := a.register(t, user); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("registration: got %d, want 400", resp.StatusCode)
+			}
+
+			_, a = registeredAuthenticator(t, "pkphish")
+			set(a)
+			if resp := a.login(t); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("login: got %d, want 401", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPasskeyMismatchedUserHandle(t *testing.T) {
+	_, a := registeredAuthenticator(t, "pkhandle")
+	other := signupUser(t, "pkother")
+
+	a.userHandle = []byte(other.UserID)
+	if resp := a.login(t); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login: got %d, want 401", resp.StatusCode)
+	}
+}
+
+//encodeCBORHead writes a CBOR major type and argument
+func encodeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg < 1<<8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg < 1<<16:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	default:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	}
+}
+
+//encodeCBORValue writes the few CBOR types the authenticator sends
+func encodeCBORValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case int64:
+		if v >= 0 {
+			encodeCBORHead(buf, 0, uint64(v))
+		} else {
+			encodeCBORHead(buf, 1, uint64(-1-v))
+		}
+	case []byte:
+		encodeCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		encodeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case map[int64]interface{}:
+		buf.Write(encodeCBORMap(v))
+	default:
+		panic(fmt.Sprintf("can't encode %T", value))
+	}
+}
+
+//encodeCBORMap encodes a map with integer keys, as COSE keys use
+func encodeCBORMap(m map[int64]interface{}) []byte {
+	keys := make([]int64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	var buf bytes.Buffer
+	encodeCBORHead(&buf, 5, uint64(len(m)))
+	for _, k := range keys {
+		encodeCBORValue(&buf, k)
+		encodeCBORValue(&buf, m[k])
+	}
+	return buf.Bytes()
+}
+
+//encodeCBORTextMap encodes a map with text keys, as the attestation object uses
+func encodeCBORTextMap(m map[string]interface{}) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	encodeCBORHead(&buf, 5, uint64(len(m)))
+	for _, k := range keys {
+		encodeCBORValue(&buf, k)
+		encodeCBORValue(&buf, m[k])
+	}
+	return buf.Bytes()
+}
+
+//pad32 left-pads a P-256 coordinate to its full 32 bytes
+func pad32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
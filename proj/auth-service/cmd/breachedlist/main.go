@@ -0,0 +1,89 @@
+//Command breachedlist builds the breached password directory BREACHED_PASSWORDS_DIR points
+//at. It reads one entry per line from stdin, either a plain password or an uppercase SHA-1
+//in the HASH:COUNT form of the Pwned Passwords downloads, and writes one <PREFIX>.txt file
+//of SUFFIX:COUNT lines per 5 character hash prefix.
+//
+//	go run ./cmd/breachedlist -out ./breached < passwords.txt
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var hashLine = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:\d+)?$`)
+
+func main() {
+	out := flag.String("out", "./breached", "directory to write the prefix files to")
+	flag.Parse()
+
+	//prefix -> suffix -> count
+	ranges := map[string]map[string]string{}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		hash, count := line, "1"
+		if hashLine.MatchString(line) {
+			if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+				hash, count = parts[0], parts[1]
+			}
+		} else {
+			sum := sha1.Sum([]byte(line))
+			hash = hex.EncodeToString(sum[:])
+		}
+		hash = strings.ToUpper(hash)
+		if ranges[hash[:5]] == nil {
+			ranges[hash[:5]] = map[string]string{}
+		}
+		ranges[hash[:5]][hash[5:]] = count
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	err := os.MkdirAll(*out, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for prefix, suffixes := range ranges {
+		lines := make([]string, 0, len(suffixes))
+		for suffix, count := range suffixes {
+			lines = append(lines, suffix+":"+count)
+		}
+		sort.Strings(lines)
+		err = writeLines(filepath.Join(*out, prefix+".txt"), lines)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("wrote %d prefix files to %s\n", len(ranges), *out)
+}
+
+func writeLines(path string, lines []string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	err = w.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	_ "net/http"
+	"time"
 
 	"github.com/BearCloud/fa20-project-dev/backend/auth-service/api"
 	"github.com/gorilla/mux"
@@ -17,8 +18,17 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	//Initialize the sendgrid client
-	api.InitMailer()
+	//Initialize the mailer, see InitMailer for the available backends
+	err = api.InitMailer()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	//Load the keys used to sign tokens
+	err = api.InitKeys()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
 	//Initialize our database connection
 	DB := api.InitDB()
@@ -38,6 +48,12 @@ func main() {
 		log.Fatal("Error registering API endpoints")
 	}
 
+	//Clean out expired verification and reset tokens in the background
+	api.StartTokenJanitor(time.Hour)
+
+	//Deliver the events other services need to hear about, retrying the ones that fail
+	api.StartOutboxWorker(5 * time.Second)
+
 	log.Println("starting go server")
 	http.ListenAndServe(":80", router)
 
@@ -0,0 +1,39 @@
+//Package authn validates the tokens minted by auth-service and provides the middleware
+//the BearChat services use to protect their routes.
+package authn
+
+import (
+	"context"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//AuthClaims represents the claims in the access token
+type AuthClaims struct {
+	Email         string `json:"Email,omitempty"`
+	EmailVerified bool   `json:"EmailVerified,omitempty"`
+	UserID        string
+	//SessionID is the login this token was minted for, the jti identifies the token itself
+	SessionID string `json:"SessionID,omitempty"`
+	//Roles are the roles the user held when the token was minted, see policy.go
+	Roles []string `json:"Roles,omitempty"`
+	//Scopes limit what an API key or an OAuth client may do, see scopes.go
+	Scopes []string `json:"Scopes,omitempty"`
+	//ClientID is the OAuth client the token was issued to, empty for BearChat's own logins
+	ClientID string `json:"ClientID,omitempty"`
+	jwt.StandardClaims
+}
+
+type contextKey struct{}
+
+//NewContext returns a copy of ctx that carries the authenticated claims
+func NewContext(ctx context.Context, claims *AuthClaims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+//FromContext returns the claims of the authenticated user. It is always set for
+//handlers mounted behind Middleware.
+func FromContext(ctx context.Context) (*AuthClaims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*AuthClaims)
+	return claims, ok
+}
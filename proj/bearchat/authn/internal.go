@@ -0,0 +1,27 @@
+package authn
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+)
+
+//InternalKeyHeader carries the shared secret the services use to call each other's internal routes
+const InternalKeyHeader = "X-Internal-Key"
+
+//InternalOnly only lets through requests carrying the shared key in InternalKeyHeader.
+//Internal routes stay closed while no key is configured.
+func InternalOnly(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := r.Header.Get(InternalKeyHeader)
+			if key == "" || subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+				http.Error(w, errors.New("internal route").Error(), http.StatusForbidden)
+				log.Print("rejected internal request to " + r.URL.Path)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
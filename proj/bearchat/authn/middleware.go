@@ -0,0 +1,55 @@
+package authn
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//Middleware rejects requests that don't carry a valid access token, either as the
+//access_token cookie or as an "Authorization: Bearer" header, and puts the claims of the
+//authenticated user into the request context. CORS preflights never carry credentials
+//so they are let through to the handler.
+func Middleware(v Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token := TokenFromRequest(r)
+			if token == "" {
+				unauthorized(w, errors.New("no access token in request"))
+				return
+			}
+			claims, err := v.Verify(token)
+			if err != nil {
+				unauthorized(w, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+		})
+	}
+}
+
+//TokenFromRequest returns the bearer token of the request, falling back to the access_token cookie
+func TokenFromRequest(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+//unauthorized writes the 401 every protected route responds with, the reason is only logged
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="bearchat"`)
+	http.Error(w, errors.New("invalid or missing access token").Error(), http.StatusUnauthorized)
+	log.Print(err.Error())
+}
@@ -0,0 +1,94 @@
+package authn
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+//Roles a user can be given on top of being a regular user
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+//Permission is a privileged action. Every check for one goes through this file so the
+//rules live in one place instead of in each handler.
+type Permission string
+
+const (
+	//PermViewAnyPosts allows listing the posts of other users
+	PermViewAnyPosts Permission = "posts:view:any"
+	//PermDeleteAnyPost allows deleting posts of other users
+	PermDeleteAnyPost Permission = "posts:delete:any"
+	//PermDeleteAnyComment allows deleting comments of other users on posts of other users
+	PermDeleteAnyComment Permission = "comments:delete:any"
+	//PermUpdateAnyProfile allows editing profiles of other users
+	PermUpdateAnyProfile Permission = "profiles:update:any"
+	//PermLockAccounts allows locking and unlocking accounts
+	PermLockAccounts Permission = "accounts:lock"
+	//PermManageRoles allows granting and taking away roles
+	PermManageRoles Permission = "roles:manage"
+	//PermViewAuditLog allows reading the authentication events of every user
+	PermViewAuditLog Permission = "audit:view"
+)
+
+//rolePermissions lists what each role may do
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:     {PermViewAnyPosts, PermDeleteAnyPost, PermDeleteAnyComment, PermUpdateAnyProfile, PermLockAccounts, PermManageRoles, PermViewAuditLog},
+	RoleModerator: {PermViewAnyPosts, PermDeleteAnyPost, PermDeleteAnyComment},
+}
+
+//ValidRole reports whether the role is one the policy knows about
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+//Allowed reports whether the user holds a role granting the permission
+func Allowed(claims *AuthClaims, perm Permission) bool {
+	if claims == nil {
+		return false
+	}
+	for _, role := range claims.Roles {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//AllowedOrOwner reports whether the user owns the resource or may act on anyone's
+func AllowedOrOwner(claims *AuthClaims, ownerID string, perm Permission) bool {
+	if claims != nil && claims.UserID != "" && claims.UserID == ownerID {
+		return true
+	}
+	return Allowed(claims, perm)
+}
+
+//Require only lets through users allowed the permission. It goes behind Middleware,
+//which puts the claims into the context.
+func Require(perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			claims, _ := FromContext(r.Context())
+			if !Allowed(claims, perm) {
+				log.Printf("%s needs %s", r.URL.Path, perm)
+				Forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//Forbidden writes the 403 every failed permission check responds with
+func Forbidden(w http.ResponseWriter) {
+	http.Error(w, errors.New("you are not allowed to do this").Error(), http.StatusForbidden)
+}
@@ -0,0 +1,80 @@
+package authn
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+//APIKeyPrefix starts every API key, so keys and JWTs can be told apart
+const APIKeyPrefix = "bck_"
+
+//SubjectAPIKey is the subject of the claims of a request made with an API key
+const SubjectAPIKey = "api_key"
+
+//Scopes an API key or OAuth client can be given. Logged in users are not limited by scopes.
+const (
+	ScopePostsRead    = "posts:read"
+	ScopePostsWrite   = "posts:write"
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+)
+
+var validScopes = map[string]bool{
+	ScopePostsRead:    true,
+	ScopePostsWrite:   true,
+	ScopeProfileRead:  true,
+	ScopeProfileWrite: true,
+}
+
+//ValidScope reports whether an API key or OAuth client can be given the scope
+func ValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+//IsAPIKey reports whether the bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+//Scoped reports whether the claims are limited by scopes. API keys and tokens issued to
+//OAuth clients are, a user logged in to BearChat itself may do everything their account may.
+func Scoped(claims *AuthClaims) bool {
+	return claims.Subject == SubjectAPIKey || claims.ClientID != ""
+}
+
+//HasScope reports whether the request may do what the scope covers
+func HasScope(claims *AuthClaims, scope string) bool {
+	if claims == nil {
+		return false
+	}
+	if !Scoped(claims) {
+		return true
+	}
+	for _, s := range claims.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//RequireScope only lets through requests whose API key or OAuth token has the scope. It goes behind
+//Middleware, which puts the claims into the context.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			claims, _ := FromContext(r.Context())
+			if !HasScope(claims, scope) {
+				log.Printf("%s needs scope %s", r.URL.Path, scope)
+				Forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
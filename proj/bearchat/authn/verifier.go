@@ -0,0 +1,115 @@
+package authn
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//Verifier turns a raw token into the claims of the user it was issued to
+type Verifier interface {
+	Verify(token string) (*AuthClaims, error)
+}
+
+//RemoteVerifier verifies access tokens against the keys auth-service publishes and
+//asks auth-service whether they have been revoked
+type RemoteVerifier struct {
+	authServiceURL string
+	client         *http.Client
+	keys           *KeySet
+}
+
+//NewRemoteVerifier returns a verifier for the auth-service running at authServiceURL
+func NewRemoteVerifier(authServiceURL string) *RemoteVerifier {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return &RemoteVerifier{
+		authServiceURL: authServiceURL,
+		client:         client,
+		keys:           NewKeySet(authServiceURL+"/.well-known/jwks.json", client),
+	}
+}
+
+func (v *RemoteVerifier) Verify(tokenString string) (*AuthClaims, error) {
+	// API keys aren't JWTs, only auth-service can tell who they belong to
+	if IsAPIKey(tokenString) {
+		claims, active, err := v.introspect(tokenString)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			return nil, errors.New("API key is not valid")
+		}
+		return claims, nil
+	}
+
+	claims, err := ParseToken(tokenString, v.keys.Key)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject != "access" {
+		return nil, errors.New("not an access token")
+	}
+
+	// A valid signature isn't enough, the user may have logged out since the token was minted
+	_, active, err := v.introspect(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, errors.New("token has been revoked")
+	}
+	return claims, nil
+}
+
+//introspect asks auth-service whether the token is still active and who it belongs to
+func (v *RemoteVerifier) introspect(tokenString string) (*AuthClaims, bool, error) {
+	body, err := json.Marshal(map[string]string{"token": tokenString})
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := v.client.Post(v.authServiceURL+"/api/auth/introspect", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("introspection failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Active bool `json:"active"`
+		AuthClaims
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, false, err
+	}
+	return &result.AuthClaims, result.Active, nil
+}
+
+//ParseToken checks the RS256 signature of the token using the key named by its kid
+//header and returns its claims
+func ParseToken(tokenString string, key func(kid string) (*rsa.PublicKey, error)) (*AuthClaims, error) {
+	claims := &AuthClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		// Don't forget to validate the alg is what you expect:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("The given token is not valid")
+	}
+	return claims, nil
+}
@@ -0,0 +1,5 @@
+module github.com/BearCloud/fa20-project-dev/backend/bearchat
+
+go 1.15
+
+require github.com/dgrijalva/jwt-go v3.2.0+incompatible
@@ -0,0 +1,67 @@
+//Package testdb runs an in-process MySQL server for the services' tests. It is loaded
+//with the schema of db-server, so handlers run the same queries they do in production
+//without a database container.
+package testdb
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"strings"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gsql "github.com/dolthub/go-mysql-server/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+//Start starts a MySQL server on a free local port, runs the SQL file at schemaPath on it
+//and returns the server's address. The server runs until the test binary exits.
+func Start(schemaPath string) (string, error) {
+	//The database server logs every connection
+	logrus.SetLevel(logrus.WarnLevel)
+
+	provider := memory.NewDBProvider()
+	engine := sqle.NewDefault(provider)
+	s, err := server.NewServer(server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}, engine, gsql.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		return "", err
+	}
+	go s.Start()
+	addr := s.Listener.Addr().String()
+
+	schema, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		return "", err
+	}
+	db, err := sql.Open("mysql", "root@tcp("+addr+")/")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	//The file switches databases with USE, so it all has to run on one connection
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	lines := []string{}
+	for _, line := range strings.Split(string(schema), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		_, err = conn.ExecContext(context.Background(), statement)
+		if err != nil {
+			return "", err
+		}
+	}
+	return addr, nil
+}
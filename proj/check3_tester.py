@@ -122,8 +122,8 @@ def test_get():
 def test_delete():
     url = "http://localhost:81/api/posts/delete/{}".format(postID2)
     response = requests.delete(url, cookies=user_cookies)
-    if response.status_code != 401:
-        fail('expected status code 401 but was {}'.format(response.status_code))
+    if response.status_code != 403:
+        fail('expected status code 403 but was {}'.format(response.status_code))
 
     url = "http://localhost:81/api/posts/delete/{}".format(postID)
     response = requests.delete(url, cookies=user_cookies)
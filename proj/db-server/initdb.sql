@@ -9,11 +9,167 @@ CREATE TABLE users (
     email VARCHAR(320),
     hashedPassword TEXT,
     verified boolean,
-    resetToken TEXT,
-    verifiedToken TEXT,
+    locked boolean DEFAULT FALSE,
     userId VARCHAR(128) PRIMARY KEY
 );
 
+CREATE TABLE user_roles (
+    userId VARCHAR(128),
+    role VARCHAR(32),
+    PRIMARY KEY (userId, role)
+);
+
+CREATE TABLE refresh_tokens (
+    tokenId VARCHAR(36) PRIMARY KEY,
+    familyId VARCHAR(36),
+    userId VARCHAR(128),
+    expiresAt DATETIME,
+    usedAt DATETIME,
+    revoked boolean DEFAULT FALSE,
+    INDEX (familyId)
+);
+
+CREATE TABLE sessions (
+    sessionId VARCHAR(36) PRIMARY KEY,
+    userId VARCHAR(128),
+    clientId VARCHAR(36) DEFAULT '',
+    device VARCHAR(64) DEFAULT '',
+    ip VARCHAR(64) DEFAULT '',
+    userAgent VARCHAR(255) DEFAULT '',
+    createdAt DATETIME,
+    lastUsedAt DATETIME,
+    revokedAt DATETIME,
+    INDEX (userId),
+    INDEX (clientId),
+    INDEX (lastUsedAt)
+);
+
+CREATE TABLE auth_tokens (
+    tokenHash CHAR(64) PRIMARY KEY,
+    purpose VARCHAR(32),
+    userId VARCHAR(128),
+    data VARCHAR(1024) DEFAULT '',
+    createdAt DATETIME,
+    expiresAt DATETIME,
+    consumedAt DATETIME,
+    INDEX (expiresAt)
+);
+
+CREATE TABLE rate_limit_attempts (
+    attemptKey VARCHAR(400),
+    attemptedAt DATETIME(3),
+    INDEX (attemptKey, attemptedAt)
+);
+
+CREATE TABLE rate_limit_lockouts (
+    attemptKey VARCHAR(400) PRIMARY KEY,
+    lockedUntil DATETIME,
+    lockouts INT
+);
+
+CREATE TABLE mfa_totp (
+    userId VARCHAR(128) PRIMARY KEY,
+    secret VARCHAR(64),
+    confirmed boolean DEFAULT FALSE,
+    lastUsedStep BIGINT DEFAULT 0
+);
+
+CREATE TABLE mfa_recovery_codes (
+    userId VARCHAR(128),
+    codeHash CHAR(64),
+    usedAt DATETIME,
+    INDEX (userId)
+);
+
+CREATE TABLE api_keys (
+    keyId VARCHAR(36) PRIMARY KEY,
+    userId VARCHAR(128),
+    name VARCHAR(64),
+    prefix VARCHAR(16),
+    keyHash CHAR(64) UNIQUE,
+    scopes VARCHAR(255),
+    createdAt DATETIME,
+    lastUsedAt DATETIME,
+    revokedAt DATETIME,
+    INDEX (userId)
+);
+
+CREATE TABLE oauth_clients (
+    clientId VARCHAR(36) PRIMARY KEY,
+    userId VARCHAR(128),
+    name VARCHAR(64),
+    redirectUris TEXT,
+    scopes VARCHAR(255),
+    secretHash VARCHAR(64) DEFAULT '',
+    createdAt DATETIME,
+    INDEX (userId)
+);
+
+CREATE TABLE oauth_grants (
+    userId VARCHAR(128),
+    clientId VARCHAR(36),
+    scopes VARCHAR(255),
+    createdAt DATETIME,
+    PRIMARY KEY (userId, clientId),
+    INDEX (clientId)
+);
+
+CREATE TABLE external_identities (
+    provider VARCHAR(32),
+    subject VARCHAR(255),
+    userId VARCHAR(128),
+    email VARCHAR(255),
+    createdAt DATETIME,
+    PRIMARY KEY (provider, subject),
+    INDEX (userId)
+);
+
+CREATE TABLE webauthn_credentials (
+    credentialId VARCHAR(255) PRIMARY KEY,
+    userId VARCHAR(128),
+    name VARCHAR(64),
+    publicKey BLOB,
+    signCount INT UNSIGNED,
+    createdAt DATETIME,
+    lastUsedAt DATETIME NULL,
+    INDEX (userId)
+);
+
+CREATE TABLE auth_events (
+    eventId BIGINT AUTO_INCREMENT PRIMARY KEY,
+    eventType VARCHAR(32),
+    userId VARCHAR(128),
+    ip VARCHAR(64),
+    userAgent VARCHAR(255),
+    outcome VARCHAR(16),
+    createdAt DATETIME,
+    INDEX (userId, eventId),
+    INDEX (eventType, eventId)
+);
+
+CREATE TABLE outbox_events (
+    eventId VARCHAR(36) PRIMARY KEY,
+    jobId VARCHAR(36),
+    eventType VARCHAR(32),
+    target VARCHAR(32),
+    method VARCHAR(8),
+    path VARCHAR(255),
+    payload TEXT,
+    createdAt DATETIME,
+    attempts INT DEFAULT 0,
+    nextAttemptAt DATETIME,
+    lastError TEXT,
+    completedAt DATETIME,
+    INDEX (jobId),
+    INDEX (completedAt, nextAttemptAt)
+);
+
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(36) PRIMARY KEY,
+    expiresAt DATETIME,
+    INDEX (expiresAt)
+);
+
 CREATE DATABASE postsDB;
 
 USE postsDB;
@@ -22,7 +178,52 @@ CREATE TABLE posts (
     content VARCHAR(255),
     postID VARCHAR(36) PRIMARY KEY,
     authorID VARCHAR(36),
-    postTime DATETIME
+    postTime DATETIME,
+    fannedOut boolean DEFAULT FALSE,
+    editedAt DATETIME NULL,
+    INDEX (postTime, postID),
+    INDEX (authorID, postTime, postID)
+);
+
+CREATE TABLE follows (
+    followerID VARCHAR(36),
+    followeeID VARCHAR(36),
+    createdAt DATETIME,
+    PRIMARY KEY (followerID, followeeID),
+    INDEX (followerID, createdAt, followeeID),
+    INDEX (followeeID, createdAt, followerID)
+);
+
+CREATE TABLE timelines (
+    userID VARCHAR(36),
+    postID VARCHAR(36),
+    authorID VARCHAR(36),
+    postTime DATETIME,
+    PRIMARY KEY (userID, postTime, postID),
+    INDEX (postID),
+    INDEX (authorID, userID)
+);
+
+CREATE TABLE post_revisions (
+    revisionID BIGINT AUTO_INCREMENT PRIMARY KEY,
+    postID VARCHAR(36),
+    content VARCHAR(255),
+    createdAt DATETIME,
+    replacedAt DATETIME,
+    INDEX (postID, revisionID)
+);
+
+CREATE TABLE comments (
+    commentID VARCHAR(36) PRIMARY KEY,
+    postID VARCHAR(36),
+    parentID VARCHAR(36) NULL,
+    authorID VARCHAR(36),
+    content VARCHAR(255),
+    createdAt DATETIME,
+    editedAt DATETIME NULL,
+    INDEX (postID, parentID, createdAt, commentID),
+    INDEX (parentID, createdAt, commentID),
+    INDEX (authorID)
 );
 
 CREATE DATABASE profiles;
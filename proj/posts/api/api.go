@@ -5,42 +5,75 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"os"
 	"time"
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"database/sql"
 	"strconv"
 )
 
+//authServiceURL is where access tokens are verified
+var authServiceURL = "http://172.28.1.1"
 
 func RegisterRoutes(router *mux.Router) error {
 	// Why don't we put options here? Check main.go :)
-
-	router.HandleFunc("/api/posts/{startIndex}", getFeed).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/posts/{uuid}/{startIndex}", getPosts).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/posts/create", createPost).Methods(http.MethodPost, http.MethodOptions)
-	router.HandleFunc("/api/posts/delete/{postID}", deletePost).Methods(http.MethodDelete, http.MethodOptions)
-
-	return nil
-}
-
-func getUUID (w http.ResponseWriter, r *http.Request) (uuid string) {
-	cookie, err := r.Cookie("access_token")
-	if err != nil {
-		http.Error(w, errors.New("error obtaining cookie: " + err.Error()).Error(), http.StatusBadRequest)
-		log.Print(err.Error())
-		return
+	if url := os.Getenv("AUTH_SERVICE_URL"); url != "" {
+		authServiceURL = url
 	}
-	//validate the cookie
-	claims, err := ValidateToken(cookie.Value)
-	if err != nil {
-		http.Error(w, errors.New("error validating token: " + err.Error()).Error(), http.StatusUnauthorized)
-		log.Print(err.Error())
-		return
+	if value := os.Getenv("FANOUT_MAX_FOLLOWERS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		fanOutLimit = n
 	}
-	log.Println(claims)
 
-	return claims["UserID"].(string)
+	// Every posts route needs a logged in user
+	protected := router.NewRoute().Subrouter()
+	protected.Use(authn.Middleware(authn.NewRemoteVerifier(authServiceURL)))
+
+	// API keys also need the scope of the route, logged in users don't
+	read := authn.RequireScope(authn.ScopePostsRead)
+	write := authn.RequireScope(authn.ScopePostsWrite)
+
+	// Cursor pages, these have to come before the index routes they would otherwise match
+	protected.Handle("/api/posts", read(http.HandlerFunc(getFeedPage))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/posts/home", read(http.HandlerFunc(getHomePage))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/posts/explore", read(http.HandlerFunc(getFeedPage))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/posts/user/{uuid}", read(http.HandlerFunc(getPostsPage))).Methods(http.MethodGet, http.MethodOptions)
+
+	// Edits, the history route has to come before the index routes as well
+	protected.Handle("/api/posts/{postID}", write(http.HandlerFunc(editPost))).Methods(http.MethodPut, http.MethodOptions)
+	protected.Handle("/api/posts/{postID}/revisions", read(http.HandlerFunc(getRevisions))).Methods(http.MethodGet, http.MethodOptions)
+
+	// Comments, listing them has to come before the index routes too
+	protected.Handle("/api/posts/{postID}/comments", write(http.HandlerFunc(createComment))).Methods(http.MethodPost, http.MethodOptions)
+	protected.Handle("/api/posts/{postID}/comments", read(http.HandlerFunc(getComments))).Methods(http.MethodGet)
+	protected.Handle("/api/comments/{commentID}/replies", read(http.HandlerFunc(getReplies))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/comments/{commentID}", write(http.HandlerFunc(editComment))).Methods(http.MethodPut, http.MethodOptions)
+	protected.Handle("/api/comments/{commentID}", write(http.HandlerFunc(deleteComment))).Methods(http.MethodDelete)
+
+	// Index routes, kept for clients that haven't moved to cursors
+	protected.Handle("/api/posts/{startIndex}", read(http.HandlerFunc(getFeed))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/posts/{uuid}/{startIndex}", read(http.HandlerFunc(getPosts))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/posts/create", write(http.HandlerFunc(createPost))).Methods(http.MethodPost, http.MethodOptions)
+	protected.Handle("/api/posts/delete/{postID}", write(http.HandlerFunc(deletePost))).Methods(http.MethodDelete, http.MethodOptions)
+
+	// Follow graph
+	protected.Handle("/api/follows/{uuid}", write(http.HandlerFunc(follow))).Methods(http.MethodPut, http.MethodOptions)
+	protected.Handle("/api/follows/{uuid}", write(http.HandlerFunc(unfollow))).Methods(http.MethodDelete)
+	protected.Handle("/api/follows/{uuid}/followers", read(http.HandlerFunc(getFollowers))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/follows/{uuid}/following", read(http.HandlerFunc(getFollowing))).Methods(http.MethodGet, http.MethodOptions)
+	protected.Handle("/api/follows/{uuid}/counts", read(http.HandlerFunc(getFollowCounts))).Methods(http.MethodGet, http.MethodOptions)
+
+	// Called by auth-service, see authn.InternalOnly
+	internal := router.PathPrefix("/internal").Subrouter()
+	internal.Use(authn.InternalOnly(os.Getenv("INTERNAL_API_KEY")))
+	internal.HandleFunc("/users/{uuid}", purgeUser).Methods(http.MethodDelete)
+
+	return nil
 }
 
 func getPosts(w http.ResponseWriter, r *http.Request) {
@@ -60,12 +93,10 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 
 
 	// Check if the user is authorized
-	// First get the uuid from the access_token (see getUUID())
-	// Compare that to the uuid we got from the url parameters, if they're not the same, return an error http.StatusUnauthorized
-	// YOUR CODE HERE
-	uuid := getUUID(w, r)
-	if urlUUID != uuid {
-		http.Error(w, errors.New("UUIDs do not match").Error(), http.StatusUnauthorized)
+	// Users see their own posts, moderators may look at anyone's
+	claims, _ := authn.FromContext(r.Context())
+	if !authn.AllowedOrOwner(claims, urlUUID, authn.PermViewAnyPosts) {
+		authn.Forbidden(w)
 		return
 	}
 
@@ -78,7 +109,7 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		-Make sure to always get up to 25, and start with an offset of {startIndex} (look at the previous SQL homework for hints)\
 		-As indicated by the "posts" variable, this query returns multiple rows
 	*/
-	posts, err = DB.Query("SELECT * FROM posts WHERE authorID = ? ORDER BY postTime LIMIT ?, 25", urlUUID, startIndex)
+	posts, err = DB.Query("SELECT content, postID, authorID, postTime, editedAt, "+commentCount+" FROM posts WHERE authorID = ? ORDER BY postTime LIMIT ?, 25", urlUUID, startIndex)
 
 	// Check for errors from the query
 	// YOUR CODE HERE
@@ -94,6 +125,8 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		postID string
 		userid string
 		postTime time.Time
+		editedAt *time.Time
+		comments int
 	)
 	numPosts := 0
 	// Create "postsArray", which is a slice (array) of Posts. Make sure it has size 25
@@ -104,7 +137,7 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		// Every time we call posts.Next() we get access to the next row returned from our query
 		// Question: How many columns did we return
 		// Reminder: Scan() scans the rows in order of their columns. See the variables defined up above for your convenience
-		err = posts.Scan(&content, &postID, &userid, &postTime)
+		err = posts.Scan(&content, &postID, &userid, &postTime, &editedAt, &comments)
 
 		// Check for errors in scanning
 		// YOUR CODE HERE
@@ -118,7 +151,7 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		// Check post.go for the structure of a Post
 		// Hint: https://gobyexample.com/structs
 		//YOUR CODE HERE
-		postsArray[i] = Post{PostBody: content, PostID: postID, AuthorID: userid, PostTime: postTime, PostAuthor: userid}
+		postsArray[i] = Post{PostBody: content, PostID: postID, AuthorID: userid, PostTime: postTime, PostAuthor: userid, EditedAt: editedAt, CommentCount: comments}
 
 		numPosts++
 	}
@@ -140,9 +173,10 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 
 func createPost(w http.ResponseWriter, r *http.Request) {
 	// Obtain the userID from the JSON Web Token
-	// See getUUID(...)
+	// See authn.FromContext(...)
 	// YOUR CODE HERE
-	userID := getUUID(w, r)
+	claims, _ := authn.FromContext(r.Context())
+	userID := claims.UserID
 
 	// Create a Post object and then Decode the JSON Body (which has the structure of a Post) into that object
 	// YOUR CODE HERE
@@ -192,6 +226,9 @@ func createPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Push the post into the followers' home timelines
+	fanOut(postID.String(), userID, currPST)
+
 	// What kind of HTTP header should we return since we created something?
 	// Check your signup from Checkpoint 2!
 	// YOUR CODE HERE
@@ -208,9 +245,9 @@ func deletePost(w http.ResponseWriter, r *http.Request) {
 	// YOUR CODE HERE
 	postID := mux.Vars(r)["postID"]
 
-	// Get the uuid from the access token, see getUUID(...)
+	// Get the uuid from the access token, see authn.FromContext(...)
 	// YOUR CODE HERE
-	uuid := getUUID(w, r)
+	claims, _ := authn.FromContext(r.Context())
 
 	var exists bool
 	//check if post exists
@@ -243,12 +280,10 @@ func deletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the uuid from the access token is the same as the authorID from the query
-	// If not, return http.StatusUnauthorized
-	// YOUR CODE HERE
-	if uuid != authorID {
-		http.Error(w, errors.New("uuid from access token does not match authorID from db query").Error(), http.StatusUnauthorized)
-		log.Print("uuid from access token does not match authorID from db query")
+	// Authors may delete their own posts, moderators may delete any post
+	if !authn.AllowedOrOwner(claims, authorID, authn.PermDeleteAnyPost) {
+		authn.Forbidden(w)
+		log.Print(claims.UserID + " may not delete post " + postID)
 		return
 	}
 
@@ -263,6 +298,28 @@ func deletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Its edit history and comments go with it
+	_, err = DB.Exec("DELETE FROM post_revisions WHERE postID = ?", postID)
+	if err != nil {
+		http.Error(w, errors.New("error in deleting the post revisions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM comments WHERE postID = ?", postID)
+	if err != nil {
+		http.Error(w, errors.New("error in deleting the post comments").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	// Take it out of the timelines it was fanned out to
+	_, err = DB.Exec("DELETE FROM timelines WHERE postID = ?", postID)
+	if err != nil {
+		http.Error(w, errors.New("error in deleting the post from timelines").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
 	return
 }
 
@@ -288,13 +345,14 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 	// Get the userID from the access_token
 	// You should now be familiar with how to do so
 	// YOUR CODE HERE
-	uuid := getUUID(w, r)
+	claims, _ := authn.FromContext(r.Context())
+	uuid := claims.UserID
 
 	// Obtain all of the posts where the authorID is *NOT* the current authorID
 	// Sort chronologically
 	// Always limit to 25 queries
 	// Always start at an offset of startIndex
-	posts, err := DB.Query("SELECT * FROM posts WHERE authorID <> ? ORDER BY postTime LIMIT ?, 25", uuid, startIndex)
+	posts, err := DB.Query("SELECT content, postID, authorID, postTime, editedAt, "+commentCount+" FROM posts WHERE authorID <> ? ORDER BY postTime LIMIT ?, 25", uuid, startIndex)
 
 	// Check for errors in executing the query
 	// YOUR CODE HERE
@@ -309,6 +367,8 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 		postID string
 		userid string
 		postTime time.Time
+		editedAt *time.Time
+		comments int
 	)
 
 	// Put all the posts into an array of Max Size 25 and return all the filled spots
@@ -323,13 +383,13 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 	numPosts := 0
 	postsArray := make([]Post, 25)
 	for i := 0; i < 25 && posts.Next(); i++ {
-		err = posts.Scan(&content, &postID, &userid, &postTime)
+		err = posts.Scan(&content, &postID, &userid, &postTime, &editedAt, &comments)
 		if err != nil {
 			http.Error(w, errors.New("error in scanning query contents into variables").Error(), http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
-		postsArray[i] = Post{PostBody: content, PostID: postID, AuthorID: userid, PostTime: postTime, PostAuthor: userid}
+		postsArray[i] = Post{PostBody: content, PostID: postID, AuthorID: userid, PostTime: postTime, PostAuthor: userid, EditedAt: editedAt, CommentCount: comments}
 		numPosts++
 	}
 	posts.Close()
@@ -341,3 +401,68 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
   json.NewEncoder(w).Encode(postsArray[:numPosts])
   return;
 }
+
+//getPostsPage is getPosts with a cursor instead of a start index
+func getPostsPage(w http.ResponseWriter, r *http.Request) {
+	urlUUID := mux.Vars(r)["uuid"]
+
+	claims, _ := authn.FromContext(r.Context())
+	if !authn.AllowedOrOwner(claims, urlUUID, authn.PermViewAnyPosts) {
+		authn.Forbidden(w)
+		return
+	}
+
+	servePostPage(w, r, postsWhere([]string{"authorID = ?"}, []interface{}{urlUUID}))
+}
+
+//getFeedPage is getFeed with a cursor instead of a start index
+func getFeedPage(w http.ResponseWriter, r *http.Request) {
+	claims, _ := authn.FromContext(r.Context())
+	servePostPage(w, r, postsWhere([]string{"authorID <> ?"}, []interface{}{claims.UserID}))
+}
+
+//purgeUser deletes every post, revision, comment and follow of a deleted account, with the
+//comments on its posts and the replies to its comments. Deleting twice is harmless, so
+//auth-service can retry until it gets through.
+func purgeUser(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+
+	// MySQL won't read the table it deletes from in a subquery unless it is copied first
+	_, err := DB.Exec("DELETE FROM comments WHERE parentID IN (SELECT commentID FROM (SELECT commentID FROM comments WHERE authorID = ?) AS own)", uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting comments").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM comments WHERE authorID = ? OR postID IN (SELECT postID FROM posts WHERE authorID = ?)", uuid, uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting comments").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM post_revisions WHERE postID IN (SELECT postID FROM posts WHERE authorID = ?)", uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting post revisions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM posts WHERE authorID = ?", uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting posts").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM follows WHERE followerID = ? OR followeeID = ?", uuid, uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting follows").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM timelines WHERE userID = ? OR authorID = ?", uuid, uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting timelines").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+//Comment is a comment on a post, or a reply to one when ParentID is set. Replies can't
+//be replied to, so threads are one level deep.
+type Comment struct {
+	CommentID  string     `json:"commentID"`
+	PostID     string     `json:"postID"`
+	ParentID   *string    `json:"parentID"`
+	AuthorID   string     `json:"authorID"`
+	Body       string     `json:"body"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	EditedAt   *time.Time `json:"editedAt"`
+	ReplyCount int        `json:"replyCount"`
+}
+
+//commentPage is a page of comments, oldest first. Pass nextCursor to get the next one.
+type commentPage struct {
+	Items      []Comment `json:"items"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+//commentCount is the column giving the number of comments and replies on each post
+const commentCount = "(SELECT COUNT(*) FROM comments WHERE comments.postID = posts.postID)"
+
+//createComment comments on the post in the url, or replies to parentID if it's given
+func createComment(w http.ResponseWriter, r *http.Request) {
+	postID := mux.Vars(r)["postID"]
+	claims, _ := authn.FromContext(r.Context())
+
+	comment := Comment{}
+	err := json.NewDecoder(r.Body).Decode(&comment)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding Comment from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	if comment.Body == "" {
+		http.Error(w, errors.New("body can't be empty").Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = DB.QueryRow("SELECT EXISTS(SELECT * FROM posts WHERE postID = ?)", postID).Scan(&exists)
+	if err != nil {
+		http.Error(w, errors.New("error in checking postID exists").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if !exists {
+		http.Error(w, errors.New("this postID does not exist").Error(), http.StatusNotFound)
+		return
+	}
+
+	// Replies go under a comment on the same post that isn't a reply itself
+	if comment.ParentID != nil {
+		err = DB.QueryRow("SELECT EXISTS(SELECT * FROM comments WHERE commentID = ? AND postID = ? AND parentID IS NULL)", *comment.ParentID, postID).Scan(&exists)
+		if err != nil {
+			http.Error(w, errors.New("error in checking parentID exists").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if !exists {
+			http.Error(w, errors.New("parentID is not a comment on this post that can be replied to").Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	comment = Comment{
+		CommentID: uuid.New().String(),
+		PostID:    postID,
+		ParentID:  comment.ParentID,
+		AuthorID:  claims.UserID,
+		Body:      comment.Body,
+		CreatedAt: time.Now(),
+	}
+	_, err = DB.Exec("INSERT INTO comments (commentID, postID, parentID, authorID, content, createdAt) VALUES (?, ?, ?, ?, ?, ?)",
+		comment.CommentID, comment.PostID, comment.ParentID, comment.AuthorID, comment.Body, comment.CreatedAt)
+	if err != nil {
+		http.Error(w, errors.New("error in creating the comment").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+//getComments lists the comments on the post in the url, without their replies
+func getComments(w http.ResponseWriter, r *http.Request) {
+	serveCommentPage(w, r, "postID = ? AND parentID IS NULL", mux.Vars(r)["postID"])
+}
+
+//getReplies lists the replies to the comment in the url
+func getReplies(w http.ResponseWriter, r *http.Request) {
+	serveCommentPage(w, r, "parentID = ?", mux.Vars(r)["commentID"])
+}
+
+//serveCommentPage lists the comments matching condition, oldest first
+func serveCommentPage(w http.ResponseWriter, r *http.Request, condition string, arg string) {
+	limit, err := pageLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	statement := "SELECT c.commentID, c.postID, c.parentID, c.authorID, c.content, c.createdAt, c.editedAt, " +
+		"(SELECT COUNT(*) FROM comments replies WHERE replies.parentID = c.commentID) FROM comments c WHERE " + condition
+	args := []interface{}{arg}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil || cursor.direction != cursorNewer {
+			http.Error(w, errors.New("cursor is not valid").Error(), http.StatusBadRequest)
+			return
+		}
+		statement += " AND (c.createdAt > ? OR (c.createdAt = ? AND c.commentID > ?))"
+		args = append(args, cursor.at, cursor.at, cursor.id)
+	}
+	//Ask for one extra row to know whether there is a next page
+	statement += " ORDER BY c.createdAt ASC, c.commentID ASC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := DB.Query(statement, args...)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving comments").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	page := commentPage{Items: []Comment{}}
+	for rows.Next() {
+		var c Comment
+		err = rows.Scan(&c.CommentID, &c.PostID, &c.ParentID, &c.AuthorID, &c.Body, &c.CreatedAt, &c.EditedAt, &c.ReplyCount)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving comments").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		page.Items = append(page.Items, c)
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = postCursor{cursorNewer, last.CreatedAt, last.CommentID}.encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+//editComment replaces the body of a comment. Only its author may.
+func editComment(w http.ResponseWriter, r *http.Request) {
+	commentID := mux.Vars(r)["commentID"]
+	claims, _ := authn.FromContext(r.Context())
+
+	edit := Comment{}
+	err := json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding Comment from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	if edit.Body == "" {
+		http.Error(w, errors.New("body can't be empty").Error(), http.StatusBadRequest)
+		return
+	}
+
+	comment, _, err := findComment(commentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, errors.New("this commentID does not exist").Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error in getting the comment").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if comment.AuthorID != claims.UserID {
+		authn.Forbidden(w)
+		log.Print(claims.UserID + " may not edit comment " + commentID)
+		return
+	}
+
+	now := time.Now()
+	_, err = DB.Exec("UPDATE comments SET content = ?, editedAt = ? WHERE commentID = ?", edit.Body, now, commentID)
+	if err != nil {
+		http.Error(w, errors.New("error in editing the comment").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	comment.Body = edit.Body
+	comment.EditedAt = &now
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+//deleteComment deletes a comment and its replies. Its author may, so may the author of
+//the post it is on, and so may moderators.
+func deleteComment(w http.ResponseWriter, r *http.Request) {
+	commentID := mux.Vars(r)["commentID"]
+	claims, _ := authn.FromContext(r.Context())
+
+	comment, postAuthorID, err := findComment(commentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, errors.New("this commentID does not exist").Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error in getting the comment").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if postAuthorID != claims.UserID && !authn.AllowedOrOwner(claims, comment.AuthorID, authn.PermDeleteAnyComment) {
+		authn.Forbidden(w)
+		log.Print(claims.UserID + " may not delete comment " + commentID)
+		return
+	}
+
+	_, err = DB.Exec("DELETE FROM comments WHERE commentID = ? OR parentID = ?", commentID, commentID)
+	if err != nil {
+		http.Error(w, errors.New("error in deleting the comment").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//findComment gets a comment and the author of the post it is on
+func findComment(commentID string) (Comment, string, error) {
+	var c Comment
+	var postAuthorID string
+	err := DB.QueryRow("SELECT c.commentID, c.postID, c.parentID, c.authorID, c.content, c.createdAt, c.editedAt, "+
+		"(SELECT COUNT(*) FROM comments replies WHERE replies.parentID = c.commentID), posts.authorID "+
+		"FROM comments c JOIN posts ON posts.postID = c.postID WHERE c.commentID = ?", commentID).
+		Scan(&c.CommentID, &c.PostID, &c.ParentID, &c.AuthorID, &c.Body, &c.CreatedAt, &c.EditedAt, &c.ReplyCount, &postAuthorID)
+	return c, postAuthorID, err
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+)
+
+//commentOn comments on the post as the user, or replies to parentID if it isn't empty
+func commentOn(t *testing.T, userID string, postID string, parentID string) *Comment {
+	t.Helper()
+	body := map[string]string{"body": "comment by " + userID}
+	if parentID != "" {
+		body["parentID"] = parentID
+	}
+	w := request(t, http.MethodPost, "/api/posts/"+postID+"/comments", body, userID)
+	if w.Code != http.StatusCreated {
+		return nil
+	}
+	var comment Comment
+	decode(t, w, &comment)
+	return &comment
+}
+
+//comments reads the first page of comments on the post
+func comments(t *testing.T, userID string, postID string) []Comment {
+	t.Helper()
+	w := request(t, http.MethodGet, "/api/posts/"+postID+"/comments", nil, userID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("comments: got %d %s", w.Code, w.Body.String())
+	}
+	var page commentPage
+	decode(t, w, &page)
+	return page.Items
+}
+
+func TestRepliesAreOneLevelDeep(t *testing.T) {
+	author, commenter := newTestUser(), newTestUser()
+	postID := createTestPost(t, author, "thread "+author)
+
+	comment := commentOn(t, commenter, postID, "")
+	if comment == nil {
+		t.Fatal("couldn't comment")
+	}
+	reply := commentOn(t, author, postID, comment.CommentID)
+	if reply == nil || reply.ParentID == nil || *reply.ParentID != comment.CommentID {
+		t.Fatalf("got reply %+v", reply)
+	}
+
+	//A reply can't be replied to, and neither can a comment on another post
+	if commentOn(t, commenter, postID, reply.CommentID) != nil {
+		t.Error("replied to a reply")
+	}
+	otherPost := createTestPost(t, author, "other "+author)
+	if commentOn(t, commenter, otherPost, comment.CommentID) != nil {
+		t.Error("replied to a comment on another post")
+	}
+
+	got := comments(t, commenter, postID)
+	if len(got) != 1 || got[0].CommentID != comment.CommentID || got[0].ReplyCount != 1 {
+		t.Errorf("got comments %+v, want the comment with one reply", got)
+	}
+	w := request(t, http.MethodGet, "/api/comments/"+comment.CommentID+"/replies", nil, commenter)
+	var replies commentPage
+	decode(t, w, &replies)
+	if len(replies.Items) != 1 || replies.Items[0].CommentID != reply.CommentID {
+		t.Errorf("got replies %+v", replies.Items)
+	}
+}
+
+func TestWhoDeletesComments(t *testing.T) {
+	author, commenter, stranger := newTestUser(), newTestUser(), newTestUser()
+	postID := createTestPost(t, author, "moderated "+author)
+
+	comment := commentOn(t, commenter, postID, "")
+	if comment == nil {
+		t.Fatal("couldn't comment")
+	}
+	commentOn(t, stranger, postID, comment.CommentID)
+	w := request(t, http.MethodDelete, "/api/comments/"+comment.CommentID, nil, stranger)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("delete by a stranger: got %d, want 403", w.Code)
+	}
+	w = request(t, http.MethodPut, "/api/comments/"+comment.CommentID, map[string]string{"body": "edited"}, author)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("edit by the post author: got %d, want 403", w.Code)
+	}
+
+	//The author of the post can delete comments on it, their replies go with them
+	w = request(t, http.MethodDelete, "/api/comments/"+comment.CommentID, nil, author)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete by the post author: got %d %s", w.Code, w.Body.String())
+	}
+	if got := comments(t, author, postID); len(got) != 0 {
+		t.Errorf("got comments %+v, want none", got)
+	}
+	var left int
+	err := DB.QueryRow("SELECT COUNT(*) FROM comments WHERE postID = ?", postID).Scan(&left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d replies are left", left)
+	}
+
+	comment = commentOn(t, commenter, postID, "")
+	if comment == nil {
+		t.Fatal("couldn't comment")
+	}
+	w = request(t, http.MethodDelete, "/api/comments/"+comment.CommentID, nil, newTestUser(authn.RoleModerator))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("delete by a moderator: got %d, want 204", w.Code)
+	}
+}
+
+func TestFeedItemsCountComments(t *testing.T) {
+	author, follower := newTestUser(), newTestUser()
+	followTestUser(t, follower, author)
+	postID := createTestPost(t, author, "counted "+author)
+
+	comment := commentOn(t, follower, postID, "")
+	if comment == nil {
+		t.Fatal("couldn't comment")
+	}
+	commentOn(t, author, postID, comment.CommentID)
+	commentOn(t, follower, postID, "")
+
+	//Replies count too
+	if page := homePage(t, follower); len(page.Items) != 1 || page.Items[0].CommentCount != 3 {
+		t.Errorf("home: got %+v, want the post with 3 comments", page.Items)
+	}
+	if page := userPage(t, author, "10", ""); len(page.Items) != 1 || page.Items[0].CommentCount != 3 {
+		t.Errorf("user page: got %+v, want the post with 3 comments", page.Items)
+	}
+	w := request(t, http.MethodGet, "/api/posts/"+author+"/0", nil, author)
+	var posts []Post
+	decode(t, w, &posts)
+	if len(posts) != 1 || posts[0].CommentCount != 3 {
+		t.Errorf("index page: got %+v, want the post with 3 comments", posts)
+	}
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPostPage = 25
+	maxPostPage     = 100
+)
+
+//Cursor directions. Pages are newest first, so older walks down the feed and newer
+//walks back up it.
+const (
+	cursorOlder = "o"
+	cursorNewer = "n"
+)
+
+//postPage is a page of posts, newest first. Pass nextCursor to get older posts and
+//prevCursor to get posts newer than this page, including ones written since it was read.
+type postPage struct {
+	Items      []Post `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	PrevCursor string `json:"prevCursor,omitempty"`
+}
+
+//postCursor is a position in a feed. Posts are ordered by (postTime, postID) so two
+//posts written in the same second still have a fixed order. Follow lists use it the
+//same way with the time and user of the follow.
+type postCursor struct {
+	direction string
+	at        time.Time
+	id        string
+}
+
+//encode turns the cursor into the opaque string handed to clients
+func (c postCursor) encode() string {
+	raw := c.direction + "|" + strconv.FormatInt(c.at.UnixNano(), 10) + "|" + c.id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (postCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return postCursor{}, err
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 || (parts[0] != cursorOlder && parts[0] != cursorNewer) {
+		return postCursor{}, errors.New("malformed cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return postCursor{}, err
+	}
+	return postCursor{direction: parts[0], at: time.Unix(0, nanos).UTC(), id: parts[2]}, nil
+}
+
+//pageLimit reads the limit query parameter, capped at maxPostPage
+func pageLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPostPage, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New("limit must be a positive number")
+	}
+	if n > maxPostPage {
+		return maxPostPage, nil
+	}
+	return n, nil
+}
+
+//postQuery is one source of posts for a page. from is the table expression to read and
+//key the table in it whose postTime and postID order the page, so its index is the one
+//used. Conditions are ANDed together.
+type postQuery struct {
+	from       string
+	key        string
+	conditions []string
+	args       []interface{}
+}
+
+//postsWhere reads straight from the posts table
+func postsWhere(conditions []string, args []interface{}) postQuery {
+	return postQuery{from: "posts", key: "posts", conditions: conditions, args: args}
+}
+
+//servePostPage answers a cursor request with the posts of every query merged by time
+func servePostPage(w http.ResponseWriter, r *http.Request, queries ...postQuery) {
+	limit, err := pageLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cursor *postCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		decoded, err := decodeCursor(value)
+		if err != nil {
+			http.Error(w, errors.New("cursor is not valid").Error(), http.StatusBadRequest)
+			return
+		}
+		cursor = &decoded
+	}
+
+	page, err := readPostPage(queries, cursor, limit)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving posts").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+//readPostPage runs the keyset query of every source and merges them into one page. Newer
+//pages are read oldest first, so the rows right after the cursor come back, and then flipped.
+func readPostPage(queries []postQuery, cursor *postCursor, limit int) (postPage, error) {
+	newer := cursor != nil && cursor.direction == cursorNewer
+
+	items := []Post{}
+	seen := map[string]bool{}
+	for _, query := range queries {
+		posts, err := queryPosts(query, cursor, limit+1)
+		if err != nil {
+			return postPage{}, err
+		}
+		//A post can be in more than one source while it is being fanned out
+		for _, post := range posts {
+			if !seen[post.PostID] {
+				seen[post.PostID] = true
+				items = append(items, post)
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if newer {
+			return postBefore(items[i], items[j])
+		}
+		return postBefore(items[j], items[i])
+	})
+
+	more := len(items) > limit
+	if more {
+		items = items[:limit]
+	}
+	if newer {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	page := postPage{Items: items}
+	if len(items) == 0 {
+		//Nothing newer yet, keep handing back the same cursor so clients can poll it
+		if newer {
+			page.PrevCursor = cursor.encode()
+		}
+		return page, nil
+	}
+	first, last := items[0], items[len(items)-1]
+	page.PrevCursor = postCursor{cursorNewer, first.PostTime, first.PostID}.encode()
+	//Coming back up the feed there is always the page we came from below
+	if more || newer {
+		page.NextCursor = postCursor{cursorOlder, last.PostTime, last.PostID}.encode()
+	}
+	return page, nil
+}
+
+//queryPosts reads up to n posts of one source past the cursor, in the order of the page
+func queryPosts(query postQuery, cursor *postCursor, n int) ([]Post, error) {
+	conditions := append([]string{}, query.conditions...)
+	args := append([]interface{}{}, query.args...)
+
+	postTime, postID := query.key+".postTime", query.key+".postID"
+	order := " ORDER BY " + postTime + " DESC, " + postID + " DESC"
+	if cursor != nil {
+		if cursor.direction == cursorNewer {
+			conditions = append(conditions, "("+postTime+" > ? OR ("+postTime+" = ? AND "+postID+" > ?))")
+			order = " ORDER BY " + postTime + " ASC, " + postID + " ASC"
+		} else {
+			conditions = append(conditions, "("+postTime+" < ? OR ("+postTime+" = ? AND "+postID+" < ?))")
+		}
+		args = append(args, cursor.at, cursor.at, cursor.id)
+	}
+
+	statement := "SELECT posts.content, posts.postID, posts.authorID, posts.postTime, posts.editedAt, " + commentCount + " FROM " + query.from
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += order + " LIMIT ?"
+	args = append(args, n)
+
+	rows, err := DB.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var post Post
+		err = rows.Scan(&post.PostBody, &post.PostID, &post.AuthorID, &post.PostTime, &post.EditedAt, &post.CommentCount)
+		if err != nil {
+			return nil, err
+		}
+		post.PostAuthor = post.AuthorID
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+//postBefore reports whether a comes before b in (postTime, postID) order
+func postBefore(a Post, b Post) bool {
+	if !a.PostTime.Equal(b.PostTime) {
+		return a.PostTime.Before(b.PostTime)
+	}
+	return a.PostID < b.PostID
+}
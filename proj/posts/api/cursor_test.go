@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//insertTestPost writes a post of the author at the given time straight into the table
+func insertTestPost(t *testing.T, authorID string, at time.Time) string {
+	t.Helper()
+	postID := uuid.New().String()
+	_, err := DB.Exec("INSERT INTO posts (content, postID, authorID, postTime) VALUES (?, ?, ?, ?)", "post "+postID, postID, authorID, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postID
+}
+
+//userPage reads a page of the author's posts as them
+func userPage(t *testing.T, authorID string, limit string, cursor string) postPage {
+	t.Helper()
+	query := url.Values{"limit": {limit}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	w := request(t, http.MethodGet, "/api/posts/user/"+authorID+"?"+query.Encode(), nil, authorID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("user page: got %d %s", w.Code, w.Body.String())
+	}
+	var page postPage
+	decode(t, w, &page)
+	return page
+}
+
+func postIDs(posts []Post) []string {
+	ids := []string{}
+	for _, post := range posts {
+		ids = append(ids, post.PostID)
+	}
+	return ids
+}
+
+func equalIDs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCursorPagesBothWays(t *testing.T) {
+	author := newTestUser()
+	base := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+
+	//Three posts share a second, their ids have to keep them in order
+	posts := []Post{}
+	for _, offset := range []int{0, 1, 2, 2, 2, 3, 4} {
+		at := base.Add(time.Duration(offset) * time.Minute)
+		posts = append(posts, Post{PostID: insertTestPost(t, author, at), PostTime: at})
+	}
+	sort.Slice(posts, func(i, j int) bool { return postBefore(posts[j], posts[i]) })
+	want := postIDs(posts)
+
+	//Walking down the feed two at a time sees every post once, newest first
+	pages := [][]string{}
+	got := []string{}
+	cursor := ""
+	prevCursors := []string{}
+	for {
+		page := userPage(t, author, "2", cursor)
+		pages = append(pages, postIDs(page.Items))
+		prevCursors = append(prevCursors, page.PrevCursor)
+		got = append(got, postIDs(page.Items)...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+		if len(pages) > len(want) {
+			t.Fatal("the pages don't end")
+		}
+	}
+	if !equalIDs(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	//Walking back up from the last page gives the same pages again
+	for i := len(pages) - 1; i > 0; i-- {
+		page := userPage(t, author, "2", prevCursors[i])
+		if !equalIDs(postIDs(page.Items), pages[i-1]) {
+			t.Errorf("going up from page %d: got %v, want %v", i, postIDs(page.Items), pages[i-1])
+		}
+		if page.NextCursor == "" {
+			t.Errorf("going up from page %d: no cursor back down", i)
+		}
+	}
+}
+
+func TestCursorPollsForNewPosts(t *testing.T) {
+	author := newTestUser()
+	insertTestPost(t, author, time.Now().UTC().Truncate(time.Second).Add(-time.Minute))
+
+	top := userPage(t, author, "10", "")
+	if len(top.Items) != 1 || top.PrevCursor == "" {
+		t.Fatalf("got %+v, want one post and a cursor to poll", top)
+	}
+
+	//Nothing new yet, the same cursor comes back to poll again
+	poll := userPage(t, author, "10", top.PrevCursor)
+	if len(poll.Items) != 0 || poll.PrevCursor != top.PrevCursor {
+		t.Fatalf("got %+v, want no posts and the same cursor", poll)
+	}
+
+	newPost := insertTestPost(t, author, time.Now().UTC().Truncate(time.Second))
+	poll = userPage(t, author, "10", poll.PrevCursor)
+	if len(poll.Items) != 1 || poll.Items[0].PostID != newPost {
+		t.Errorf("got %v, want the new post", postIDs(poll.Items))
+	}
+}
+
+func TestCursorRejectsBadParameters(t *testing.T) {
+	author := newTestUser()
+	for name, query := range map[string]string{
+		"limit":  "limit=0",
+		"cursor": "cursor=not-a-cursor",
+	} {
+		w := request(t, http.MethodGet, "/api/posts/user/"+author+"?"+query, nil, author)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("bad %s: got %d, want 400", name, w.Code)
+		}
+	}
+}
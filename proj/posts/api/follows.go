@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+//Follow is one entry of a follower or following list. UserID is the other user.
+type Follow struct {
+	UserID     string    `json:"uuid"`
+	FollowedAt time.Time `json:"followedAt"`
+}
+
+//followPage is a page of a follow list, newest first, with the size of the whole list
+type followPage struct {
+	Items      []Follow `json:"items"`
+	Count      int      `json:"count"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+//follow makes the caller follow the user in the url. Following someone twice is harmless.
+func follow(w http.ResponseWriter, r *http.Request) {
+	followeeID := mux.Vars(r)["uuid"]
+	claims, _ := authn.FromContext(r.Context())
+
+	//posts has no table of users to check against, but every user id is a uuid
+	if _, err := uuid.Parse(followeeID); err != nil {
+		http.Error(w, errors.New("this uuid is not valid").Error(), http.StatusBadRequest)
+		return
+	}
+	if followeeID == claims.UserID {
+		http.Error(w, errors.New("you can't follow yourself").Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := DB.Exec("INSERT IGNORE INTO follows (followerID, followeeID, createdAt) VALUES (?, ?, ?)",
+		claims.UserID, followeeID, time.Now())
+	if err != nil {
+		http.Error(w, errors.New("error following user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	err = backfillTimeline(claims.UserID, followeeID)
+	if err != nil {
+		http.Error(w, errors.New("error filling timeline").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//unfollow stops the caller following the user in the url
+func unfollow(w http.ResponseWriter, r *http.Request) {
+	followeeID := mux.Vars(r)["uuid"]
+	claims, _ := authn.FromContext(r.Context())
+
+	_, err := DB.Exec("DELETE FROM follows WHERE followerID = ? AND followeeID = ?", claims.UserID, followeeID)
+	if err != nil {
+		http.Error(w, errors.New("error unfollowing user").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = DB.Exec("DELETE FROM timelines WHERE userID = ? AND authorID = ?", claims.UserID, followeeID)
+	if err != nil {
+		http.Error(w, errors.New("error clearing timeline").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//getFollowers lists who follows the user in the url
+func getFollowers(w http.ResponseWriter, r *http.Request) {
+	serveFollowPage(w, r, "followerID", "followeeID")
+}
+
+//getFollowing lists who the user in the url follows
+func getFollowing(w http.ResponseWriter, r *http.Request) {
+	serveFollowPage(w, r, "followeeID", "followerID")
+}
+
+//serveFollowPage lists the follows whose match column is the user in the url, giving the
+//user in the other column of each
+func serveFollowPage(w http.ResponseWriter, r *http.Request, other string, match string) {
+	userID := mux.Vars(r)["uuid"]
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := followPage{Items: []Follow{}}
+	err = DB.QueryRow("SELECT COUNT(*) FROM follows WHERE "+match+" = ?", userID).Scan(&page.Count)
+	if err != nil {
+		http.Error(w, errors.New("error counting follows").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	statement := "SELECT " + other + ", createdAt FROM follows WHERE " + match + " = ?"
+	args := []interface{}{userID}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil || cursor.direction != cursorOlder {
+			http.Error(w, errors.New("cursor is not valid").Error(), http.StatusBadRequest)
+			return
+		}
+		statement += " AND (createdAt < ? OR (createdAt = ? AND " + other + " < ?))"
+		args = append(args, cursor.at, cursor.at, cursor.id)
+	}
+	//Ask for one extra row to know whether there is a next page
+	statement += " ORDER BY createdAt DESC, " + other + " DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := DB.Query(statement, args...)
+	if err != nil {
+		http.Error(w, errors.New("error retrieving follows").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f Follow
+		err = rows.Scan(&f.UserID, &f.FollowedAt)
+		if err != nil {
+			http.Error(w, errors.New("error retrieving follows").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		page.Items = append(page.Items, f)
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = postCursor{cursorOlder, last.FollowedAt, last.UserID}.encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+//FollowCounts is how many users follow a user and how many they follow
+type FollowCounts struct {
+	Followers int `json:"followers"`
+	Following int `json:"following"`
+}
+
+//getFollowCounts returns both follow counts of the user in the url
+func getFollowCounts(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["uuid"]
+
+	var counts FollowCounts
+	err := DB.QueryRow("SELECT (SELECT COUNT(*) FROM follows WHERE followeeID = ?), (SELECT COUNT(*) FROM follows WHERE followerID = ?)",
+		userID, userID).Scan(&counts.Followers, &counts.Following)
+	if err != nil {
+		http.Error(w, errors.New("error counting follows").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
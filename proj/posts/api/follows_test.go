@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+//followCounts reads both follow counts of the user
+func followCounts(t *testing.T, userID string) FollowCounts {
+	t.Helper()
+	w := request(t, http.MethodGet, "/api/follows/"+userID+"/counts", nil, userID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("counts: got %d %s", w.Code, w.Body.String())
+	}
+	var counts FollowCounts
+	decode(t, w, &counts)
+	return counts
+}
+
+func TestFollowAndUnfollow(t *testing.T) {
+	author, follower := newTestUser(), newTestUser()
+
+	//Following twice is harmless
+	followTestUser(t, follower, author)
+	followTestUser(t, follower, author)
+	if counts := followCounts(t, author); counts.Followers != 1 || counts.Following != 0 {
+		t.Errorf("author: got %+v, want one follower", counts)
+	}
+	if counts := followCounts(t, follower); counts.Followers != 0 || counts.Following != 1 {
+		t.Errorf("follower: got %+v, want one followed", counts)
+	}
+
+	w := request(t, http.MethodGet, "/api/follows/"+author+"/followers", nil, follower)
+	var followers followPage
+	decode(t, w, &followers)
+	if followers.Count != 1 || len(followers.Items) != 1 || followers.Items[0].UserID != follower {
+		t.Errorf("got followers %+v", followers)
+	}
+
+	postID := createTestPost(t, author, "followed "+author)
+	if !inTimeline(t, follower, postID) {
+		t.Fatal("the post is not in the follower's timeline")
+	}
+
+	//Unfollowing takes the author's posts out of the timeline
+	w = request(t, http.MethodDelete, "/api/follows/"+author, nil, follower)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unfollow: got %d %s", w.Code, w.Body.String())
+	}
+	if inTimeline(t, follower, postID) {
+		t.Error("the post is still in the timeline after unfollowing")
+	}
+	if page := homePage(t, follower); len(page.Items) != 0 {
+		t.Errorf("got home timeline %v, want it empty", postIDs(page.Items))
+	}
+	if counts := followCounts(t, author); counts.Followers != 0 {
+		t.Errorf("author: got %+v, want no followers", counts)
+	}
+}
+
+func TestFollowRejectsBadUsers(t *testing.T) {
+	user := newTestUser()
+	for name, target := range map[string]string{
+		"yourself":   user,
+		"not a uuid": "someone",
+	} {
+		w := request(t, http.MethodPut, "/api/follows/"+target, nil, user)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("following %s: got %d, want 400", name, w.Code)
+		}
+	}
+}
+
+func TestFollowListPages(t *testing.T) {
+	user := newTestUser()
+	followees := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		followee := newTestUser()
+		followees[followee] = true
+		followTestUser(t, user, followee)
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for i := 0; i < 3; i++ {
+		target := "/api/follows/" + user + "/following?limit=1"
+		if cursor != "" {
+			target += "&cursor=" + cursor
+		}
+		w := request(t, http.MethodGet, target, nil, user)
+		var page followPage
+		decode(t, w, &page)
+		if page.Count != 3 || len(page.Items) != 1 {
+			t.Fatalf("got page %+v, want one of three", page)
+		}
+		seen[page.Items[0].UserID] = true
+		cursor = page.NextCursor
+		if (cursor == "") != (i == 2) {
+			t.Fatalf("page %d: got next cursor %q", i, cursor)
+		}
+	}
+	for followee := range followees {
+		if !seen[followee] {
+			t.Errorf("%s is missing from the list", followee)
+		}
+	}
+}
+
+func TestHomeTimelineReadsPostsNotFannedOut(t *testing.T) {
+	popular, follower := newTestUser(), newTestUser()
+	followTestUser(t, follower, popular)
+
+	//Posts of authors over FANOUT_MAX_FOLLOWERS are never fanned out and read from posts
+	postID := insertTestPost(t, popular, time.Now().UTC().Truncate(time.Second))
+	if inTimeline(t, follower, postID) {
+		t.Fatal("the post was fanned out")
+	}
+	if page := homePage(t, follower); len(page.Items) != 1 || page.Items[0].PostID != postID {
+		t.Errorf("got home timeline %v, want the post", postIDs(page.Items))
+	}
+}
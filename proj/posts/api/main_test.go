@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/testdb"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+//testRouter has every route of the service, set up the way main.go does it
+var testRouter *mux.Router
+
+//testTokens are the users the stand-in auth-service knows, by bearer token
+var (
+	testTokensMu sync.Mutex
+	testTokens   = map[string]*authn.AuthClaims{}
+)
+
+//TestMain runs the tests against an in-process MySQL server loaded with the schema of
+//db-server, so they run the same queries the handlers do in production. POSTS_TEST_DSN
+//points them at a real MySQL server instead, they write to it so give it a scratch copy
+//of postsDB.
+func TestMain(m *testing.M) {
+	dsn := os.Getenv("POSTS_TEST_DSN")
+	if dsn == "" {
+		addr, err := testdb.Start("../../db-server/initdb.sql")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dsn = "root@tcp(" + addr + ")/postsDB?parseTime=true"
+	}
+	var err error
+	DB, err = sql.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Tokens are checked by auth-service, a stand-in answers for the users of newTestUser
+	auth := httptest.NewServer(http.HandlerFunc(introspectTestToken))
+	defer auth.Close()
+	os.Setenv("AUTH_SERVICE_URL", auth.URL)
+
+	testRouter = mux.NewRouter()
+	err = RegisterRoutes(testRouter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	auth.Close()
+	os.Exit(code)
+}
+
+//introspectTestToken answers /api/auth/introspect like auth-service does for an API key.
+//The claims have no api_key subject, so they aren't limited by scopes.
+func introspectTestToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	testTokensMu.Lock()
+	claims, ok := testTokens[body.Token]
+	testTokensMu.Unlock()
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]bool{"active": false})
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Active bool `json:"active"`
+		*authn.AuthClaims
+	}{true, claims})
+}
+
+//testToken is the bearer token of a test user
+func testToken(userID string) string {
+	return authn.APIKeyPrefix + "test_" + userID
+}
+
+//newTestUser makes up a user with the roles and returns their id
+func newTestUser(roles ...string) string {
+	userID := uuid.New().String()
+	testTokensMu.Lock()
+	testTokens[testToken(userID)] = &authn.AuthClaims{UserID: userID, Roles: roles}
+	testTokensMu.Unlock()
+	return userID
+}
+
+//request runs a request of the user through testRouter, body is encoded as JSON
+func request(t *testing.T, method string, target string, body interface{}, userID string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+testToken(userID))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	return w
+}
+
+//decode reads the JSON body of a response into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	err := json.NewDecoder(strings.NewReader(w.Body.String())).Decode(v)
+	if err != nil {
+		t.Fatalf("decoding %q: %s", w.Body.String(), err)
+	}
+}
@@ -8,4 +8,6 @@ type Post struct {
 	AuthorID string    `json:"AuthorID"`
 	PostTime time.Time `json:"postTime"`
 	PostAuthor string `json:"postAuthor"`
+	EditedAt *time.Time `json:"editedAt"`
+	CommentCount int `json:"commentCount"`
 }
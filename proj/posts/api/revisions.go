@@ -0,0 +1,139 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+	"github.com/gorilla/mux"
+)
+
+//Revision is an earlier version of a post, from when it was written until an edit replaced it
+type Revision struct {
+	PostBody   string    `json:"postBody"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ReplacedAt time.Time `json:"replacedAt"`
+}
+
+//editPost replaces the body of a post and keeps the old one as a revision. The post keeps
+//its postTime, so it stays where it was in every feed.
+func editPost(w http.ResponseWriter, r *http.Request) {
+	postID := mux.Vars(r)["postID"]
+	claims, _ := authn.FromContext(r.Context())
+
+	edit := Post{}
+	err := json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding Post from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	if edit.PostBody == "" {
+		http.Error(w, errors.New("postBody can't be empty").Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		http.Error(w, errors.New("error in editing the post").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	post := Post{PostID: postID}
+	err = tx.QueryRow("SELECT content, authorID, postTime, editedAt FROM posts WHERE postID = ? FOR UPDATE", postID).
+		Scan(&post.PostBody, &post.AuthorID, &post.PostTime, &post.EditedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, errors.New("this postID does not exist").Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, errors.New("error in getting the post").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	// Only the author may edit a post, moderators can delete it but not put words in it
+	if post.AuthorID != claims.UserID {
+		authn.Forbidden(w)
+		log.Print(claims.UserID + " may not edit post " + postID)
+		return
+	}
+
+	// The version being replaced was written when the post was, or at its last edit
+	createdAt := post.PostTime
+	if post.EditedAt != nil {
+		createdAt = *post.EditedAt
+	}
+	now := time.Now()
+	_, err = tx.Exec("INSERT INTO post_revisions (postID, content, createdAt, replacedAt) VALUES (?, ?, ?, ?)",
+		postID, post.PostBody, createdAt, now)
+	if err != nil {
+		http.Error(w, errors.New("error in saving the revision").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = tx.Exec("UPDATE posts SET content = ?, editedAt = ? WHERE postID = ?", edit.PostBody, now, postID)
+	if err != nil {
+		http.Error(w, errors.New("error in editing the post").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, errors.New("error in editing the post").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	post.PostBody = edit.PostBody
+	post.PostAuthor = post.AuthorID
+	post.EditedAt = &now
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(post)
+}
+
+//getRevisions lists the earlier versions of a post, newest first
+func getRevisions(w http.ResponseWriter, r *http.Request) {
+	postID := mux.Vars(r)["postID"]
+
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT * FROM posts WHERE postID = ?)", postID).Scan(&exists)
+	if err != nil {
+		http.Error(w, errors.New("error in checking postID exists").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if !exists {
+		http.Error(w, errors.New("this postID does not exist").Error(), http.StatusNotFound)
+		return
+	}
+
+	rows, err := DB.Query("SELECT content, createdAt, replacedAt FROM post_revisions WHERE postID = ? ORDER BY revisionID DESC", postID)
+	if err != nil {
+		http.Error(w, errors.New("error in getting the revisions").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var revision Revision
+		err = rows.Scan(&revision.PostBody, &revision.CreatedAt, &revision.ReplacedAt)
+		if err != nil {
+			http.Error(w, errors.New("error in getting the revisions").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+)
+
+//editTestPost edits the post as the user and returns the status code
+func editTestPost(t *testing.T, userID string, postID string, body string) int {
+	t.Helper()
+	w := request(t, http.MethodPut, "/api/posts/"+postID, map[string]string{"postBody": body}, userID)
+	return w.Code
+}
+
+//revisions reads the revisions of the post as the user
+func revisions(t *testing.T, userID string, postID string) []Revision {
+	t.Helper()
+	w := request(t, http.MethodGet, "/api/posts/"+postID+"/revisions", nil, userID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revisions: got %d %s", w.Code, w.Body.String())
+	}
+	revisions := []Revision{}
+	decode(t, w, &revisions)
+	return revisions
+}
+
+func TestOnlyTheAuthorEditsAPost(t *testing.T) {
+	author := newTestUser()
+	postID := createTestPost(t, author, "mine "+author)
+
+	//Moderators can delete the post but not change what it says
+	for name, userID := range map[string]string{
+		"someone else": newTestUser(),
+		"a moderator":  newTestUser(authn.RoleModerator),
+		"an admin":     newTestUser(authn.RoleAdmin),
+	} {
+		if code := editTestPost(t, userID, postID, "not mine"); code != http.StatusForbidden {
+			t.Errorf("edit by %s: got %d, want 403", name, code)
+		}
+	}
+	if got := revisions(t, author, postID); len(got) != 0 {
+		t.Errorf("got %d revisions, want none", len(got))
+	}
+
+	if code := editTestPost(t, author, newTestUser(), "missing"); code != http.StatusNotFound {
+		t.Errorf("edit of a missing post: got %d, want 404", code)
+	}
+	if code := editTestPost(t, author, postID, ""); code != http.StatusBadRequest {
+		t.Errorf("empty edit: got %d, want 400", code)
+	}
+}
+
+func TestRevisionsNewestFirst(t *testing.T) {
+	author := newTestUser()
+	postID := createTestPost(t, author, "first "+author)
+	for _, body := range []string{"second", "third"} {
+		if code := editTestPost(t, author, postID, body); code != http.StatusOK {
+			t.Fatalf("edit: got %d", code)
+		}
+	}
+
+	got := revisions(t, author, postID)
+	if len(got) != 2 || got[0].PostBody != "second" || got[1].PostBody != "first "+author {
+		t.Fatalf("got %+v, want second then first", got)
+	}
+	//Each version was written when the one before it was replaced
+	if !got[0].CreatedAt.Equal(got[1].ReplacedAt) || got[1].ReplacedAt.Before(got[1].CreatedAt) {
+		t.Errorf("got times %+v", got)
+	}
+
+	//The post has the last edit and stays where it was in the feeds
+	page := userPage(t, author, "10", "")
+	if len(page.Items) != 1 || page.Items[0].PostBody != "third" || page.Items[0].EditedAt == nil {
+		t.Fatalf("got %+v, want the edited post", page.Items)
+	}
+	if !page.Items[0].PostTime.Equal(got[1].CreatedAt) {
+		t.Errorf("got postTime %s, want %s from before the edits", page.Items[0].PostTime, got[1].CreatedAt)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
+)
+
+//fanOutLimit is the most followers an author can have and still get their posts pushed
+//into every follower's timeline. Posts of authors with more are read from the posts table
+//when a follower opens their home timeline. Set by FANOUT_MAX_FOLLOWERS.
+var fanOutLimit = 5000
+
+//timelineBackfill is how many recent posts of an author are copied into the timeline of
+//someone who starts following them
+const timelineBackfill = 200
+
+//fanOut pushes a new post into the timeline of every follower of its author and marks it
+//as fanned out. Until that is done the post is read from the posts table like any post
+//that isn't, so a failure here only costs speed.
+func fanOut(postID string, authorID string, postTime time.Time) {
+	var followers int
+	err := DB.QueryRow("SELECT COUNT(*) FROM follows WHERE followeeID = ?", authorID).Scan(&followers)
+	if err != nil {
+		log.Printf("error counting followers of %s: %s", authorID, err.Error())
+		return
+	}
+	if followers > fanOutLimit {
+		return
+	}
+
+	_, err = DB.Exec("INSERT IGNORE INTO timelines (userID, postID, authorID, postTime) SELECT followerID, ?, ?, ? FROM follows WHERE followeeID = ?",
+		postID, authorID, postTime, authorID)
+	if err != nil {
+		log.Printf("error fanning out post %s: %s", postID, err.Error())
+		return
+	}
+	_, err = DB.Exec("UPDATE posts SET fannedOut = TRUE WHERE postID = ?", postID)
+	if err != nil {
+		log.Printf("error marking post %s fanned out: %s", postID, err.Error())
+	}
+}
+
+//backfillTimeline copies the recent posts of an author into the timeline of a new
+//follower. Posts that aren't fanned out yet are copied too: fanOut may have read the
+//followers just before this follow and be about to mark the post as fanned out, which
+//would take it out of the posts read from the posts table.
+func backfillTimeline(userID string, authorID string) error {
+	_, err := DB.Exec("INSERT IGNORE INTO timelines (userID, postID, authorID, postTime) SELECT ?, postID, authorID, postTime FROM posts WHERE authorID = ? ORDER BY postTime DESC LIMIT ?",
+		userID, authorID, timelineBackfill)
+	return err
+}
+
+//getHomePage is the home timeline, the posts of everyone the caller follows
+func getHomePage(w http.ResponseWriter, r *http.Request) {
+	claims, _ := authn.FromContext(r.Context())
+	servePostPage(w, r, homeQueries(claims.UserID)...)
+}
+
+//homeQueries are the sources of a user's home timeline. Fanned out posts come from their
+//timeline and the rest from the posts of who they follow.
+func homeQueries(userID string) []postQuery {
+	return []postQuery{
+		{
+			from:       "timelines JOIN posts ON posts.postID = timelines.postID",
+			key:        "timelines",
+			conditions: []string{"timelines.userID = ?"},
+			args:       []interface{}{userID},
+		},
+		postsWhere(
+			[]string{"NOT posts.fannedOut", "posts.authorID IN (SELECT followeeID FROM follows WHERE followerID = ?)"},
+			[]interface{}{userID},
+		),
+	}
+}
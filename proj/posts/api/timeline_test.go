@@ -0,0 +1,236 @@
+package api
+
+import (
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//Size of the data the home timeline benchmark reads. The timelines table only pays off
+//once reading every followed user's posts gets expensive, far past what the in-process
+//database can hold, so the benchmark needs a real MySQL server.
+const (
+	benchUsers   = 1000
+	benchFollows = 50
+	benchPosts   = 50000
+)
+
+var (
+	seedOnce  sync.Once
+	seedUsers []string
+	seedErr   error
+)
+
+//createTestPost posts as the user and returns the new post's id
+func createTestPost(t *testing.T, userID string, body string) string {
+	t.Helper()
+	w := request(t, http.MethodPost, "/api/posts/create", map[string]string{"postBody": body}, userID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create post: got %d %s", w.Code, w.Body.String())
+	}
+	var postID string
+	err := DB.QueryRow("SELECT postID FROM posts WHERE authorID = ? AND content = ?", userID, body).Scan(&postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postID
+}
+
+//followTestUser makes follower follow followee
+func followTestUser(t *testing.T, follower string, followee string) {
+	t.Helper()
+	w := request(t, http.MethodPut, "/api/follows/"+followee, nil, follower)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("follow: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+//homePage reads the first page of the user's home timeline
+func homePage(t *testing.T, userID string) postPage {
+	t.Helper()
+	w := request(t, http.MethodGet, "/api/posts/home", nil, userID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("home: got %d %s", w.Code, w.Body.String())
+	}
+	var page postPage
+	decode(t, w, &page)
+	return page
+}
+
+//inTimeline reports whether the post was pushed into the user's timelines row
+func inTimeline(t *testing.T, userID string, postID string) bool {
+	t.Helper()
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS (SELECT * FROM timelines WHERE userID = ? AND postID = ?)", userID, postID).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestCreatePostFansOut(t *testing.T) {
+	author, follower, stranger := newTestUser(), newTestUser(), newTestUser()
+	followTestUser(t, follower, author)
+
+	postID := createTestPost(t, author, "fanned out "+author)
+	if !inTimeline(t, follower, postID) {
+		t.Error("the post is not in the follower's timeline")
+	}
+	if inTimeline(t, stranger, postID) {
+		t.Error("the post is in the timeline of someone who doesn't follow the author")
+	}
+	var fannedOut bool
+	err := DB.QueryRow("SELECT fannedOut FROM posts WHERE postID = ?", postID).Scan(&fannedOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fannedOut {
+		t.Error("the post is not marked fanned out")
+	}
+	if page := homePage(t, follower); len(page.Items) != 1 || page.Items[0].PostID != postID {
+		t.Errorf("got home timeline %+v, want the post", page.Items)
+	}
+
+	w := request(t, http.MethodDelete, "/api/posts/delete/"+postID, nil, author)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d %s", w.Code, w.Body.String())
+	}
+	if inTimeline(t, follower, postID) {
+		t.Error("the deleted post is still in the follower's timeline")
+	}
+	if page := homePage(t, follower); len(page.Items) != 0 {
+		t.Errorf("got home timeline %+v, want it empty", page.Items)
+	}
+}
+
+func TestFollowBackfillsPostsBeingFannedOut(t *testing.T) {
+	author, follower := newTestUser(), newTestUser()
+
+	//fanOut has read the author's followers, found none, and is about to mark the post
+	postID := uuid.New().String()
+	_, err := DB.Exec("INSERT INTO posts (content, postID, authorID, postTime, fannedOut) VALUES (?, ?, ?, ?, FALSE)", "in flight", postID, author, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	followTestUser(t, follower, author)
+	_, err = DB.Exec("UPDATE posts SET fannedOut = TRUE WHERE postID = ?", postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page := homePage(t, follower); len(page.Items) != 1 || page.Items[0].PostID != postID {
+		t.Errorf("got home timeline %+v, want the post", page.Items)
+	}
+}
+
+//BenchmarkHomeTimeline compares reading the first home timeline page from the materialized
+//timelines table with the old query that joins follows on every read. It only runs with
+//POSTS_TEST_DSN set.
+func BenchmarkHomeTimeline(b *testing.B) {
+	if os.Getenv("POSTS_TEST_DSN") == "" {
+		b.Skip("set POSTS_TEST_DSN to a scratch MySQL database to run the benchmark")
+	}
+	seedOnce.Do(func() { seedUsers, seedErr = seedTimelines() })
+	if seedErr != nil {
+		b.Fatal(seedErr)
+	}
+
+	b.Run("timeline", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := readPostPage(homeQueries(seedUsers[rand.Intn(len(seedUsers))]), nil, defaultPostPage)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("query", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			userID := seedUsers[rand.Intn(len(seedUsers))]
+			query := postsWhere([]string{"posts.authorID IN (SELECT followeeID FROM follows WHERE followerID = ?)"}, []interface{}{userID})
+			_, err := readPostPage([]postQuery{query}, nil, defaultPostPage)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+//seedTimelines fills the database with users who follow each other at random and posts
+//fanned out the way createPost does, and returns the users
+func seedTimelines() ([]string, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	users := make([]string, benchUsers)
+	for i := range users {
+		users[i] = uuid.New().String()
+	}
+
+	followers := map[string][]string{}
+	rows := [][]interface{}{}
+	for _, follower := range users {
+		following := 0
+		for _, i := range rand.Perm(len(users)) {
+			followee := users[i]
+			if followee == follower {
+				continue
+			}
+			followers[followee] = append(followers[followee], follower)
+			rows = append(rows, []interface{}{follower, followee, now})
+			if following++; following == benchFollows {
+				break
+			}
+		}
+	}
+	err := insertRows("follows (followerID, followeeID, createdAt)", rows)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := [][]interface{}{}
+	timelines := [][]interface{}{}
+	for i := 0; i < benchPosts; i++ {
+		postID := uuid.New().String()
+		authorID := users[rand.Intn(len(users))]
+		postTime := now.Add(-time.Duration(rand.Intn(90*24*3600)) * time.Second)
+		posts = append(posts, []interface{}{"post " + postID, postID, authorID, postTime, true})
+		for _, follower := range followers[authorID] {
+			timelines = append(timelines, []interface{}{follower, postID, authorID, postTime})
+		}
+	}
+	err = insertRows("posts (content, postID, authorID, postTime, fannedOut)", posts)
+	if err != nil {
+		return nil, err
+	}
+	return users, insertRows("timelines (userID, postID, authorID, postTime)", timelines)
+}
+
+//insertRows writes rows into table, a table name followed by its column list, in batches
+func insertRows(table string, rows [][]interface{}) error {
+	const batchSize = 500
+	for len(rows) > 0 {
+		n := batchSize
+		if n > len(rows) {
+			n = len(rows)
+		}
+		batch := rows[:n]
+		rows = rows[n:]
+
+		placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(batch[0])), ", ") + ")"
+		values := make([]string, len(batch))
+		args := []interface{}{}
+		for i, row := range batch {
+			values[i] = placeholder
+			args = append(args, row...)
+		}
+		_, err := DB.Exec("INSERT INTO "+table+" VALUES "+strings.Join(values, ", "), args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,35 +1,38 @@
 package api
 
 import (
+	"database/sql"
 	"log"
 	"net/http"
+	"os"
 	"encoding/json"
 	"errors"
+	"github.com/BearCloud/fa20-project-dev/backend/bearchat/authn"
 	"github.com/gorilla/mux"
 )
 
+//authServiceURL is where access tokens are verified
+var authServiceURL = "http://172.28.1.1"
+
 func RegisterRoutes(router *mux.Router) error {
+	if url := os.Getenv("AUTH_SERVICE_URL"); url != "" {
+		authServiceURL = url
+	}
+
+	// Profiles are public, only changing one needs a logged in user
 	router.HandleFunc("/api/profile/{uuid}", getProfile).Methods(http.MethodGet)
-	router.HandleFunc("/api/profile/{uuid}", updateProfile).Methods(http.MethodPut)
 
-	return nil
-}
+	protected := router.NewRoute().Subrouter()
+	protected.Use(authn.Middleware(authn.NewRemoteVerifier(authServiceURL)))
+	protected.Handle("/api/profile/{uuid}", authn.RequireScope(authn.ScopeProfileWrite)(http.HandlerFunc(updateProfile))).Methods(http.MethodPut)
 
-func getUUID (w http.ResponseWriter, r *http.Request) (uuid string) {
-	cookie, err := r.Cookie("access_token")
-	if err != nil {
-		http.Error(w, errors.New("error obtaining cookie: " + err.Error()).Error(), http.StatusBadRequest)
-		log.Print(err.Error())
-	}
-	//validate the cookie
-	claims, err := ValidateToken(cookie.Value)
-	if err != nil {
-		http.Error(w, errors.New("error validating token: " + err.Error()).Error(), http.StatusUnauthorized)
-		log.Print(err.Error())
-	}
-	log.Println(claims)
+	// Only auth-service may call these, it owns the email and the accounts
+	internal := router.PathPrefix("/internal").Subrouter()
+	internal.Use(authn.InternalOnly(os.Getenv("INTERNAL_API_KEY")))
+	internal.HandleFunc("/profile/{uuid}/email", updateEmail).Methods(http.MethodPut)
+	internal.HandleFunc("/users/{uuid}", purgeUser).Methods(http.MethodDelete)
 
-	return claims["UserID"].(string)
+	return nil
 }
 
 func getProfile(w http.ResponseWriter, r *http.Request) {
@@ -68,15 +71,10 @@ func updateProfile(w http.ResponseWriter, r *http.Request) {
 	// YOUR CODE HERE
 	uuid := mux.Vars(r)["uuid"]
 
-	// Obtain the userID from the cookie
-	// YOUR CODE HERE
-	cookieUUID := getUUID(w, r)
-
-	// If the two ID's don't match, return a StatusUnauthorized
-	// YOUR CODE HERE
-	if uuid != cookieUUID {
-		http.Error(w, errors.New("error: two UUID's do not match").Error(), http.StatusUnauthorized)
-		// log.Print(err.Error())
+	// Users edit their own profile, admins may edit anyone's
+	claims, _ := authn.FromContext(r.Context())
+	if !authn.AllowedOrOwner(claims, uuid, authn.PermUpdateAnyProfile) {
+		authn.Forbidden(w)
 		return
 	}
 
@@ -92,10 +90,26 @@ func updateProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The profile is the one in the url, whatever the body says
+	profile.UUID = uuid
+
+	// The email is owned by auth-service, take the confirmed one from the token.
+	// Someone editing another user's profile keeps the stored address.
+	if claims.UserID == uuid {
+		profile.Email = claims.Email
+	} else {
+		err := DB.QueryRow("SELECT email FROM users WHERE uuid = ?", uuid).Scan(&profile.Email)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, errors.New("error retrieving profile").Error(), http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+
 	// Insert the profile data into the users table
 	// Check db-server/initdb.sql for the scheme
 	// Make sure to use REPLACE INTO (as covered in the SQL homework)
-	result, err := DB.Exec("INSERT INTO users (firstName, lastName, email, uuid) VALUES (?, ?, ?, ?)", profile.Firstname, profile.Lastname, profile.Email, profile.UUID)
+	result, err := DB.Exec("REPLACE INTO users (firstName, lastName, email, uuid) VALUES (?, ?, ?, ?)", profile.Firstname, profile.Lastname, profile.Email, profile.UUID)
 
 	// Return an internal server error if any errors occur when querying the database.
 	// YOUR CODE HERE
@@ -118,3 +132,41 @@ func updateProfile(w http.ResponseWriter, r *http.Request) {
 
 	return
 }
+
+//updateEmail stores the address auth-service confirmed for the user
+func updateEmail(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, errors.New("error in decoding email from request body").Error(), http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	// Users without a profile yet have nothing to update
+	_, err = DB.Exec("UPDATE users SET email = ? WHERE uuid = ?", body.Email, uuid)
+	if err != nil {
+		http.Error(w, errors.New("error updating email").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//purgeUser deletes the profile of a deleted account. Deleting twice is harmless, so
+//auth-service can retry until it gets through.
+func purgeUser(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+
+	_, err := DB.Exec("DELETE FROM users WHERE uuid = ?", uuid)
+	if err != nil {
+		http.Error(w, errors.New("error deleting profile").Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,7 +3,9 @@ module github.com/BearCloud/fa20-project-dev/backend/profile
 go 1.15
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/BearCloud/fa20-project-dev/backend/bearchat v0.0.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gorilla/mux v1.8.0
 )
+
+replace github.com/BearCloud/fa20-project-dev/backend/bearchat => ../bearchat